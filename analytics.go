@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Layout of the dates that daily reports are asked for with.
+const reportDateLayout = "2006-01-02"
+
+// AnalyticsConfig sets the heights that count as sitting and standing. It's read
+// from the "Analytics" section of controller.conf. Heights in between keep
+// whichever posture the desk was last in, so a desk that creeps around the
+// boundary doesn't count as changing back and forth.
+type AnalyticsConfig struct {
+	// The desk is sitting at or below SitBelow and standing at or above StandAbove.
+	// If either is unset, both are halfway between the sit and stand presets, or
+	// halfway up the desk if there aren't any.
+	SitBelow   Height
+	StandAbove Height
+}
+
+// Validate returns an error if the bands overlap.
+func (a AnalyticsConfig) Validate() error {
+	if a.SitBelow.Value != 0 && a.StandAbove.Value != 0 && a.SitBelow.Inches() > a.StandAbove.Inches() {
+		return fmt.Errorf("invalid Analytics config: SitBelow must not be above StandAbove")
+	}
+	return nil
+}
+
+// Posture is what the person at the desk is taken to be doing.
+type Posture int
+
+const (
+	PostureUnknown Posture = iota
+	Sitting
+	Standing
+)
+
+func (p Posture) String() string {
+	switch p {
+	case Sitting:
+		return "sitting"
+	case Standing:
+		return "standing"
+	default:
+		return "unknown"
+	}
+}
+
+// postureBands classifies heights in inches as sitting or standing.
+type postureBands struct {
+	sitBelow, standAbove float32
+}
+
+// Work out the bands from the config, falling back to the presets or the desk's range.
+func (c *Controller) postureBands() postureBands {
+	c.configMux.RLock()
+	analytics := c.Analytics
+	c.configMux.RUnlock()
+	if analytics.SitBelow.Value != 0 && analytics.StandAbove.Value != 0 {
+		return postureBands{analytics.SitBelow.Inches(), analytics.StandAbove.Inches()}
+	}
+	sit, haveSit := c.Preset("sit")
+	stand, haveStand := c.Preset("stand")
+	var middle float32
+	if haveSit && haveStand {
+		middle = (sit.Inches() + stand.Inches()) / 2
+	} else {
+		profile := c.Profile()
+		middle = (profile.MinHeight + profile.MaxHeight) / 2
+	}
+	return postureBands{middle, middle}
+}
+
+// Posture at height, or previous if it's between the bands.
+func (b postureBands) classify(height float32, previous Posture) Posture {
+	if height >= b.standAbove {
+		return Standing
+	} else if height <= b.sitBelow {
+		return Sitting
+	}
+	return previous
+}
+
+// DailyReport sums up how a desk was used over one day.
+type DailyReport struct {
+	Date            string
+	StandingMinutes float64
+	SittingMinutes  float64
+	// Number of times the desk went from sitting to standing or back.
+	Transitions int
+	// Longest time spent sitting without standing up in between, and when it started.
+	LongestSedentaryMinutes float64
+	LongestSedentaryStart   time.Time
+}
+
+// DailyReport works out the report for date (YYYY-MM-DD in local time, or today
+// if empty) from the desk's history. Days that haven't finished yet are
+// reported up to now.
+func (c *Controller) DailyReport(date string) (DailyReport, error) {
+	if c.history == nil {
+		return DailyReport{}, fmt.Errorf("history is not being recorded")
+	}
+	now := time.Now()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if date != "" {
+		var err error
+		if dayStart, err = time.ParseInLocation(reportDateLayout, date, time.Local); err != nil {
+			return DailyReport{}, fmt.Errorf("invalid date %q; expected YYYY-MM-DD", date)
+		}
+	}
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	if dayEnd.After(now) {
+		dayEnd = now
+	}
+
+	entries, err := c.history.Query(dayStart, dayEnd)
+	if err != nil {
+		return DailyReport{}, err
+	}
+	// Only changes are recorded, so the posture the desk was in when the day started
+	// comes from the last entry before it, however long ago that was.
+	last, found, err := c.history.Last(dayStart)
+	if err != nil {
+		return DailyReport{}, err
+	}
+	if found {
+		entries = append([]HistoryEntry{last}, entries...)
+	}
+	report := summarizeDay(entries, c.postureBands(), dayStart, dayEnd)
+	report.Date = dayStart.Format(reportDateLayout)
+	return report, nil
+}
+
+// Add up the time spent in each posture between start and end. Time before the
+// first entry isn't counted since we don't know where the desk was.
+func summarizeDay(entries []HistoryEntry, bands postureBands, start, end time.Time) DailyReport {
+	var report DailyReport
+	posture := PostureUnknown
+	since := start
+	var sedentary time.Duration
+	var sedentaryStart time.Time
+
+	// Count the time from since until t in the current posture.
+	advance := func(t time.Time) {
+		if t.After(end) {
+			t = end
+		}
+		if !t.After(since) {
+			return
+		}
+		elapsed := t.Sub(since)
+		switch posture {
+		case Standing:
+			report.StandingMinutes += elapsed.Minutes()
+		case Sitting:
+			report.SittingMinutes += elapsed.Minutes()
+			sedentary += elapsed
+			if sedentary.Minutes() > report.LongestSedentaryMinutes {
+				report.LongestSedentaryMinutes = sedentary.Minutes()
+				report.LongestSedentaryStart = sedentaryStart
+			}
+		}
+		since = t
+	}
+
+	for _, entry := range entries {
+		if entry.Time.After(end) {
+			break
+		}
+		advance(entry.Time)
+		next := bands.classify(entry.Height, posture)
+		if next == posture {
+			continue
+		}
+		if posture != PostureUnknown && !entry.Time.Before(start) {
+			report.Transitions++
+		}
+		if next == Sitting {
+			sedentary = 0
+			sedentaryStart = maxTime(entry.Time, start)
+		}
+		posture = next
+	}
+	advance(end)
+	return report
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Summary describes the report in a few lines of plain text.
+func (r DailyReport) Summary() []string {
+	lines := []string{
+		"Desk use on " + r.Date,
+		"Standing: " + formatMinutes(r.StandingMinutes),
+		"Sitting: " + formatMinutes(r.SittingMinutes),
+		fmt.Sprintf("Changes between sitting and standing: %d", r.Transitions),
+	}
+	if r.LongestSedentaryMinutes > 0 {
+		lines = append(lines, fmt.Sprintf("Longest time sitting: %s from %s",
+			formatMinutes(r.LongestSedentaryMinutes), r.LongestSedentaryStart.Format("15:04")))
+	}
+	return lines
+}
+
+// Format minutes like 1h 35m.
+func formatMinutes(minutes float64) string {
+	total := int(minutes + 0.5)
+	if total < 60 {
+		return fmt.Sprintf("%dm", total)
+	}
+	return fmt.Sprintf("%dh %dm", total/60, total%60)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarizeDay(t *testing.T) {
+	bands := postureBands{sitBelow: 30, standAbove: 40}
+	day := time.Date(2024, time.March, 13, 0, 0, 0, 0, time.UTC)
+	// Heights at times on the day, or the day before for negative hours.
+	at := func(hour, minute int, height float32) HistoryEntry {
+		return HistoryEntry{Time: day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute), Kind: historyHeight, Height: height}
+	}
+	const sit, between, stand = 29, 35, 41
+
+	for _, test := range []struct {
+		name    string
+		entries []HistoryEntry
+		// Hours into the day the report goes up to, if not the whole day.
+		until            int
+		sitting          float64
+		standing         float64
+		transitions      int
+		longestSedentary float64
+		sedentaryStart   time.Time
+	}{
+		{
+			name:             "sitting since before midnight",
+			entries:          []HistoryEntry{at(-2, 0, sit)},
+			sitting:          24 * 60,
+			longestSedentary: 24 * 60,
+			sedentaryStart:   day,
+		},
+		{
+			name:             "standing up after midnight",
+			entries:          []HistoryEntry{at(-1, 0, sit), at(1, 30, stand)},
+			sitting:          90,
+			standing:         22*60 + 30,
+			transitions:      1,
+			longestSedentary: 90,
+			sedentaryStart:   day,
+		},
+		{
+			// Only changes within the day count.
+			name:             "sitting down before midnight",
+			entries:          []HistoryEntry{at(-2, 0, stand), at(-1, 0, sit), at(8, 0, stand)},
+			sitting:          8 * 60,
+			standing:         16 * 60,
+			transitions:      1,
+			longestSedentary: 8 * 60,
+			sedentaryStart:   day,
+		},
+		{
+			// Nothing is known about where the desk was until the first entry.
+			name:             "no history before the day",
+			entries:          []HistoryEntry{at(9, 0, sit), at(10, 0, stand)},
+			sitting:          60,
+			standing:         14 * 60,
+			transitions:      1,
+			longestSedentary: 60,
+			sedentaryStart:   at(9, 0, sit).Time,
+		},
+		{
+			// Only changes are recorded, so a gap means the desk didn't move.
+			name:             "gap in the history",
+			entries:          []HistoryEntry{at(9, 0, sit), at(17, 0, stand), at(18, 0, sit)},
+			sitting:          8*60 + 6*60,
+			standing:         60,
+			transitions:      2,
+			longestSedentary: 8 * 60,
+			sedentaryStart:   at(9, 0, sit).Time,
+		},
+		{
+			name: "between the bands",
+			entries: []HistoryEntry{
+				at(9, 0, sit), at(10, 0, between), at(11, 0, stand), at(12, 0, between), at(13, 0, sit),
+			},
+			sitting:          2*60 + 11*60,
+			standing:         2 * 60,
+			transitions:      2,
+			longestSedentary: 11 * 60,
+			sedentaryStart:   at(13, 0, sit).Time,
+		},
+		{
+			name:             "starting between the bands",
+			entries:          []HistoryEntry{at(-1, 0, between), at(6, 0, stand)},
+			standing:         18 * 60,
+			transitions:      0,
+			longestSedentary: 0,
+		},
+		{
+			name:             "day not over yet",
+			entries:          []HistoryEntry{at(-3, 0, stand), at(9, 0, sit), at(13, 0, stand)},
+			until:            12,
+			sitting:          3 * 60,
+			standing:         9 * 60,
+			transitions:      1,
+			longestSedentary: 3 * 60,
+			sedentaryStart:   at(9, 0, sit).Time,
+		},
+		{
+			name:    "no history",
+			entries: nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			end := day.AddDate(0, 0, 1)
+			if test.until > 0 {
+				end = day.Add(time.Duration(test.until) * time.Hour)
+			}
+			report := summarizeDay(test.entries, bands, day, end)
+
+			for _, minutes := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"SittingMinutes", report.SittingMinutes, test.sitting},
+				{"StandingMinutes", report.StandingMinutes, test.standing},
+				{"LongestSedentaryMinutes", report.LongestSedentaryMinutes, test.longestSedentary},
+			} {
+				if diff := minutes.got - minutes.want; diff > 0.01 || diff < -0.01 {
+					t.Errorf("%s = %.2f; want %.2f", minutes.name, minutes.got, minutes.want)
+				}
+			}
+			if report.Transitions != test.transitions {
+				t.Errorf("Transitions = %d; want %d", report.Transitions, test.transitions)
+			}
+			if !report.LongestSedentaryStart.Equal(test.sedentaryStart) {
+				t.Errorf("LongestSedentaryStart = %s; want %s", report.LongestSedentaryStart, test.sedentaryStart)
+			}
+		})
+	}
+}
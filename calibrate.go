@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	calibratedProfileName = "calibrated"
+	// How long each step towards an end stop moves the desk for.
+	calibrationStep = 1000
+	// How long the desk is moved for when measuring its speed.
+	calibrationSpeedSample = 3000
+	// Time to let the desk come to rest and report its final height after a move.
+	calibrationSettle = 500
+	// Give up on reaching an end stop after this many steps.
+	calibrationMaxSteps = 60
+)
+
+// RunCalibration is the entry point for `sitdown calibrate`. It drives the desk to
+// both end stops, recording the raw height the desk reports at each, asks for the
+// actual height at one or both of them and writes a profile fitted to the answers
+// (along with the measured speeds) to controller.conf.
+func RunCalibration(args []string) {
+	flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	serialPort := flags.String("d", "", "Read heights from this serial device instead of the configured SerialPort")
+	buttonFile := flags.String("b", "", "Write button presses to this file instead of the GPIO pins")
+	configPath, overrides := addConfigFlags(flags)
+	flags.Parse(args)
+	if *serialPort != "" {
+		overrides.Set("Hardware.SerialPort=" + *serialPort)
+	}
+
+	controller = new(Controller)
+	controller.InitFromConfig(*configPath, *overrides)
+
+	// The current profile tells us how to read frames, but its range and conversion
+	// are what we're here to fix, so don't let it throw away heights outside of it.
+	profile := controller.Profile()
+	profile.MinHeight, profile.MaxHeight = rawProfileRange(profile)
+	desk := newDesk(controller.Hardware, profile, DeskOptions{ButtonFile: *buttonFile})
+	// Hitting the end stops is the point, so they mustn't look like obstructions.
+	desk.SetObstructionDetection(0, 0)
+	desk.Setup()
+	defer desk.Cleanup()
+
+	calibration := &calibration{desk: desk, profile: profile, input: bufio.NewReader(os.Stdin)}
+	calibrated, err := calibration.run()
+	if err != nil {
+		fmt.Println("Calibration failed: " + err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Range: %.1f\" to %.1f\"; speed up %.2f\"/s, down %.2f\"/s\n",
+		calibrated.MinHeight, calibrated.MaxHeight, calibrated.UpSpeed, calibrated.DownSpeed)
+	if err := saveProfile(controller.configPath, calibratedProfileName, calibrated); err != nil {
+		fmt.Println("Could not save calibration: " + err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Saved profile %q to %s\n", calibratedProfileName, controller.configPath)
+}
+
+type calibration struct {
+	desk    *Desk
+	profile DeskProfile
+	input   *bufio.Reader
+}
+
+func (c *calibration) run() (DeskProfile, error) {
+	if !c.waitForHeight() {
+		return DeskProfile{}, fmt.Errorf("no height reported by the desk")
+	}
+
+	fmt.Println("Lowering the desk to its lowest point")
+	if err := c.moveToEndStop("down", c.desk.LowerForDuration); err != nil {
+		return DeskProfile{}, err
+	}
+	rawLow := c.raw()
+	heightLow, hasLow := c.promptHeight("Measure the desk's height in inches (enter to skip): ")
+
+	fmt.Println("Measuring the speed going up")
+	upRate, err := c.measureRate(c.desk.RaiseForDuration)
+	if err != nil {
+		return DeskProfile{}, err
+	}
+
+	fmt.Println("Raising the desk to its highest point")
+	if err := c.moveToEndStop("up", c.desk.RaiseForDuration); err != nil {
+		return DeskProfile{}, err
+	}
+	rawHigh := c.raw()
+	heightHigh, hasHigh := c.promptHeight("Measure the desk's height in inches (enter to skip): ")
+
+	fmt.Println("Measuring the speed going down")
+	downRate, err := c.measureRate(c.desk.LowerForDuration)
+	if err != nil {
+		return DeskProfile{}, err
+	}
+
+	if rawLow == rawHigh {
+		return DeskProfile{}, fmt.Errorf("desk reported the same height at both ends")
+	}
+
+	calibrated := controller.Profile()
+	switch {
+	case hasLow && hasHigh:
+		calibrated.Scale = (heightHigh - heightLow) / float32(rawHigh-rawLow)
+		calibrated.Offset = heightLow - calibrated.Scale*float32(rawLow)
+	case hasLow:
+		calibrated.Offset = heightLow - calibrated.Scale*float32(rawLow)
+	case hasHigh:
+		calibrated.Offset = heightHigh - calibrated.Scale*float32(rawHigh)
+	default:
+		fmt.Println("No measurements given; keeping the current conversion")
+	}
+	calibrated.MinHeight = calibrated.Height(rawLow)
+	calibrated.MaxHeight = calibrated.Height(rawHigh)
+	calibrated.UpSpeed = abs(upRate * calibrated.Scale)
+	calibrated.DownSpeed = abs(downRate * calibrated.Scale)
+
+	if err := calibrated.Validate(); err != nil {
+		return DeskProfile{}, err
+	}
+	return calibrated, nil
+}
+
+// Raw height the desk is currently reporting.
+func (c *calibration) raw() int64 {
+	return c.profile.Raw(c.desk.Height())
+}
+
+func (c *calibration) waitForHeight() bool {
+	for i := 0; i < 50; i++ {
+		if c.desk.Height() != 0 {
+			return true
+		}
+		sleep(100)
+	}
+	return false
+}
+
+// Keep moving the desk in direction until the height stops changing. A move
+// that fails, e.g. because the motor guard refused it, leaves the height where it
+// was too, so that's an error rather than the end stop.
+func (c *calibration) moveToEndStop(direction string, move func(context.Context, int) error) error {
+	for i := 0; i < calibrationMaxSteps; i++ {
+		before := c.raw()
+		if err := move(context.Background(), calibrationStep); err != nil {
+			return fmt.Errorf("could not move the desk %s: %s", direction, err.Error())
+		}
+		sleep(calibrationSettle)
+		if c.raw() == before {
+			return nil
+		}
+	}
+	return fmt.Errorf("desk did not stop moving %s", direction)
+}
+
+// Move the desk for a fixed amount of time and return how fast the raw height
+// changed in steps per second.
+func (c *calibration) measureRate(move func(context.Context, int) error) (float32, error) {
+	before := c.raw()
+	start := time.Now()
+	if err := move(context.Background(), calibrationSpeedSample); err != nil {
+		return 0, fmt.Errorf("could not measure the desk's speed: %s", err.Error())
+	}
+	elapsed := time.Since(start)
+	sleep(calibrationSettle)
+	return float32(c.raw()-before) / float32(elapsed.Seconds()), nil
+}
+
+func (c *calibration) promptHeight(prompt string) (float32, bool) {
+	for {
+		fmt.Print(prompt)
+		line, err := c.input.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" || err != nil {
+			return 0, false
+		}
+		height, err := strconv.ParseFloat(line, 32)
+		if err == nil && height > 0 {
+			return float32(height), true
+		}
+		fmt.Println("Not a valid height")
+	}
+}
+
+// The heights a profile's frames are able to represent, from the smallest to
+// the largest raw value.
+func rawProfileRange(profile DeskProfile) (float32, float32) {
+	largest := int64(1)<<uint(8*profile.HeightBytes) - 1
+	low, high := profile.Height(0), profile.Height(largest)
+	if low > high {
+		return high, low
+	}
+	return low, high
+}
+
+// Add profile to the Hardware section of the config file at path and select it,
+// leaving everything else in the file alone.
+func saveProfile(path string, name string, profile DeskProfile) error {
+	return updateConfig(path, func(config map[string]interface{}) {
+		hardware, ok := config["Hardware"].(map[string]interface{})
+		if !ok {
+			hardware = make(map[string]interface{})
+			config["Hardware"] = hardware
+		}
+		profiles, ok := hardware["Profiles"].(map[string]interface{})
+		if !ok {
+			profiles = make(map[string]interface{})
+			hardware["Profiles"] = profiles
+		}
+		profiles[name] = profile
+		hardware["Profile"] = name
+	})
+}
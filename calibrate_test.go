@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// A simulated desk behind a MotorGuard with limits, like the real one.
+func newCalibration(t *testing.T, dutyCycle float64, maxOnTime int) *calibration {
+	t.Helper()
+	hardware := defaultHardwareConfig
+	hardware.DutyCycle, hardware.DutyCycleWindow, hardware.MaxOnTime = dutyCycle, 10, maxOnTime
+	profile := hardware.DeskProfile()
+	sim := NewSimulatedDesk(profile)
+	desk := NewDesk(hardware.MotorGuard(sim), sim, profile)
+	desk.Setup()
+	t.Cleanup(desk.Cleanup)
+	c := &calibration{desk: desk, profile: profile}
+	if !c.waitForHeight() {
+		t.Fatal("no height from the simulated desk")
+	}
+	return c
+}
+
+// A move the guard refuses leaves the desk where it was, which mustn't be taken
+// for an end stop or a speed of zero.
+func TestCalibrationRefusedMoves(t *testing.T) {
+	// Too little of the window for a single step.
+	c := newCalibration(t, 0.05, defaultHardwareConfig.MaxOnTime)
+	if err := c.moveToEndStop("up", c.desk.RaiseForDuration); err == nil || !strings.Contains(err.Error(), "move refused") {
+		t.Errorf("moveToEndStop = %v; want the guard's refusal", err)
+	}
+
+	// The speed sample is longer than the motor may run for at once.
+	c = newCalibration(t, 0, calibrationSpeedSample/2)
+	if _, err := c.measureRate(c.desk.RaiseForDuration); err == nil || !strings.Contains(err.Error(), "move refused") {
+		t.Errorf("measureRate = %v; want the guard's refusal", err)
+	}
+}
+
+func TestCalibrationEndStop(t *testing.T) {
+	c := newCalibration(t, 0, defaultHardwareConfig.MaxOnTime)
+	// The simulated desk starts at its lowest point.
+	if err := c.moveToEndStop("down", c.desk.LowerForDuration); err != nil {
+		t.Errorf("moveToEndStop = %s", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Captured serial streams are text files with one line per read from the port:
+// the time since the capture started in microseconds followed by the bytes in hex.
+//
+//	0 9801006e
+//	50213 9801006f
+
+var errReplayFinished = errors.New("end of recording")
+
+// captureReader copies everything read from the underlying reader into a capture file.
+type captureReader struct {
+	reader io.Reader
+	out    io.Writer
+	start  time.Time
+}
+
+func newCaptureReader(reader io.Reader, out io.Writer) *captureReader {
+	return &captureReader{reader: reader, out: out, start: time.Now()}
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if n > 0 {
+		elapsed := time.Since(c.start) / time.Microsecond
+		if _, werr := fmt.Fprintf(c.out, "%d %x\n", elapsed, p[:n]); werr != nil {
+			deskLog.Error("Could not write to capture file", "err", werr)
+		}
+	}
+	return n, err
+}
+
+// replayReader plays a capture file back with the original timing divided by
+// speed. A speed of 0 replays as fast as the reader will take it.
+type replayReader struct {
+	scanner *bufio.Scanner
+	speed   float64
+	start   time.Time
+	line    int
+	pending []byte
+}
+
+func newReplayReader(reader io.Reader, speed float64) *replayReader {
+	return &replayReader{
+		scanner: bufio.NewScanner(reader),
+		speed:   speed,
+		start:   time.Now(),
+	}
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, errReplayFinished
+		}
+		r.line++
+
+		fields := strings.Fields(r.scanner.Text())
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("capture line %d: expected timestamp and data", r.line)
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("capture line %d: %s", r.line, err.Error())
+		}
+		if r.pending, err = hex.DecodeString(fields[1]); err != nil {
+			return 0, fmt.Errorf("capture line %d: %s", r.line, err.Error())
+		}
+
+		if r.speed > 0 {
+			due := time.Duration(float64(offset)/r.speed) * time.Microsecond
+			time.Sleep(due - time.Since(r.start))
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// ReplayHeightSensor is a HeightSensor that reads a capture file instead of the
+// serial port, so that field recordings go through the same decoding as live data.
+type ReplayHeightSensor struct {
+	path    string
+	speed   float64
+	profile DeskProfile
+	file    *os.File
+	decoder *FrameDecoder
+}
+
+func NewReplayHeightSensor(path string, speed float64, profile DeskProfile) *ReplayHeightSensor {
+	return &ReplayHeightSensor{path: path, speed: speed, profile: profile}
+}
+
+func (s *ReplayHeightSensor) Setup() error {
+	var err error
+	if s.file, err = os.Open(s.path); err != nil {
+		return err
+	}
+	deskLog.Info("Replaying serial stream", "file", s.path, "speed", s.speed)
+	s.decoder = NewFrameDecoder(newReplayReader(s.file, s.speed), s.profile)
+	return nil
+}
+
+func (s *ReplayHeightSensor) ReadHeight() (float32, error) {
+	height, err := readHeight(s.decoder)
+	if err == errReplayFinished {
+		stats := s.decoder.Stats.Load()
+		deskLog.Info("Finished replaying serial stream", "file", s.path,
+			"frames", stats.Frames, "badFrames", stats.BadFrames, "skippedBytes", stats.SkippedBytes)
+		return 0, errSensorClosed
+	}
+	return height, err
+}
+
+// Stats returns the counts of frames decoded from the recording so far.
+func (s *ReplayHeightSensor) Stats() FrameStats {
+	if s.decoder == nil {
+		return FrameStats{}
+	}
+	return s.decoder.Stats.Load()
+}
+
+func (s *ReplayHeightSensor) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+const configFilename = "controller.conf"
+
+// Prefix of the environment variables that override config fields.
+const configEnvPrefix = "SITDOWN_"
+
+// Config is everything that can be set in controller.conf. Every field can also
+// be overridden by an environment variable or on the command line.
+type Config struct {
+	// Name of the controller, which commands are addressed to.
+	ID     string
+	PubKey string
+	SubKey string
+	// Port the HTTP server listens on in desk control mode.
+	Port int
+	// How controllers talk to each other.
+	Messaging MessagingConfig
+
+	// Wiring and range of the desk, only used in desk control mode.
+	Hardware HardwareConfig
+	// Named heights that can be used wherever a height is expected.
+	Presets map[string]Height
+	// Where the desk's height history is kept, only used in desk control mode.
+	History HistoryConfig
+	// Heights that count as sitting and standing for reports.
+	Analytics AnalyticsConfig
+	// Where to log to and how much.
+	Logging LoggingConfig
+	// Modes to enable when the desk starts.
+	Modes ModesConfig
+	// Whether the desk shows up in Home Assistant.
+	HomeAssistant HomeAssistantConfig
+	// Path of the file saying who may send the desk which commands. Relative paths
+	// are relative to controller.conf. Everything is allowed if there isn't one.
+	PolicyFile string
+}
+
+// ModesConfig sets which modes are enabled when sitdown starts in desk control mode.
+type ModesConfig struct {
+	BellToll bool
+	// Height or preset to keep the desk at, or empty to leave it be.
+	FixHeight string
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:      8080,
+		Messaging: defaultMessagingConfig,
+		Hardware:  defaultHardwareConfig,
+		History:   defaultHistoryConfig,
+		Logging:   defaultLoggingConfig,
+
+		HomeAssistant: defaultHomeAssistantConfig,
+		PolicyFile:    "policy.conf",
+	}
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (c Config) Validate() error {
+	var problems []string
+	if c.ID == "" {
+		problems = append(problems, "ID must be set")
+	} else if isReservedSender(c.ID) {
+		problems = append(problems, fmt.Sprintf("ID must not be %s, which is used for requests that don't come from a controller", c.ID))
+	} else if c.HomeAssistant.Enabled {
+		if err := checkHomeAssistantID(c.ID); err != nil {
+			problems = append(problems, err.Error())
+		}
+	} else if c.Messaging.Transport == transportMQTT {
+		if err := checkTopicID(c.ID); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.Messaging.Transport == transportPubNub && (c.PubKey == "" || c.SubKey == "") {
+		problems = append(problems, "PubKey and SubKey must be set")
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		problems = append(problems, "Port must be between 1 and 65535")
+	}
+	for name := range c.Presets {
+		if !validPresetName(name) {
+			problems = append(problems, fmt.Sprintf("invalid preset name %q", name))
+		}
+	}
+	if c.Modes.FixHeight != "" {
+		if _, ok := c.Presets[c.Modes.FixHeight]; !ok {
+			if _, err := ParseHeight(c.Modes.FixHeight); err != nil {
+				problems = append(problems, "Modes.FixHeight must be a height or the name of a preset")
+			}
+		}
+	}
+	if c.HomeAssistant.Enabled {
+		for _, err := range []error{c.HomeAssistant.Validate(), c.Messaging.MQTT.Validate()} {
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	for _, err := range []error{c.Messaging.Validate(), c.Hardware.Validate(), c.History.Validate(), c.Analytics.Validate(), c.Logging.Validate()} {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// Where controller.conf is looked for, in order, unless a path is given.
+func configSearchPath() []string {
+	paths := []string{configFilename}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "sitdown", configFilename))
+	}
+	return append(paths, "/etc/sitdown/"+configFilename, "/home/pi/"+configFilename)
+}
+
+// LoadConfig reads the config from path, or from the SITDOWN_CONFIG environment
+// variable or the first file on the search path if path is empty. Environment
+// variables are then applied, followed by overrides in the form Field.Path=value.
+// There doesn't have to be a config file if everything that's required is set
+// some other way, in which case the path returned is empty.
+func LoadConfig(path string, overrides []string) (Config, string, error) {
+	config := defaultConfig()
+	if path == "" {
+		path = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if path == "" {
+		for _, candidate := range configSearchPath() {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, "", err
+		}
+		if err := decodeConfig(path, contents, &config); err != nil {
+			return config, "", err
+		}
+	}
+
+	var problems []string
+	walkConfig(reflect.ValueOf(&config).Elem(), nil, func(field []string, value reflect.Value) {
+		name := configEnvName(field)
+		if env, ok := os.LookupEnv(name); ok {
+			if err := setConfigField(value, env); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err.Error()))
+			}
+		}
+	})
+	for _, override := range overrides {
+		if err := overrideConfig(&config, override); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return config, path, errors.New(strings.Join(problems, "\n"))
+	}
+
+	if err := config.Validate(); err != nil {
+		if path == "" {
+			return config, path, fmt.Errorf("no %s found in %s\n%s",
+				configFilename, strings.Join(configSearchPath(), ", "), err.Error())
+		}
+		return config, path, err
+	}
+	return config, path, nil
+}
+
+// Decode a config file into v, which already holds the defaults. Fields that
+// don't exist are errors so that typos don't go unnoticed.
+func decodeConfig(path string, contents []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, column := configPosition(contents, syntaxErr.Offset)
+		return fmt.Errorf("%s:%d:%d: %s", path, line, column, syntaxErr.Error())
+	case errors.As(err, &typeErr):
+		line, column := configPosition(contents, typeErr.Offset)
+		return fmt.Errorf("%s:%d:%d: %s must be %s, not %s", path, line, column, typeErr.Field, typeErr.Type, typeErr.Value)
+	default:
+		// Unknown fields don't come with an offset, so point at the first use of the name.
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if offset := bytes.Index(contents, []byte(name)); offset >= 0 {
+				line, column := configPosition(contents, int64(offset))
+				return fmt.Errorf("%s:%d:%d: unknown field %s", path, line, column, name)
+			}
+		}
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+}
+
+// Line and column of offset in contents, counting from 1.
+func configPosition(contents []byte, offset int64) (int, int) {
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+	before := contents[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// Apply an override in the form Field.Path=value, e.g. Hardware.UpPin=17.
+func overrideConfig(config *Config, override string) error {
+	key, value, ok := strings.Cut(override, "=")
+	if !ok {
+		return fmt.Errorf("invalid override %q; expected Field=value", override)
+	}
+	found := false
+	var err error
+	walkConfig(reflect.ValueOf(config).Elem(), nil, func(field []string, fieldValue reflect.Value) {
+		if strings.EqualFold(strings.Join(field, "."), key) {
+			found = true
+			if err = setConfigField(fieldValue, value); err != nil {
+				err = fmt.Errorf("%s: %s", key, err.Error())
+			}
+		}
+	})
+	if !found {
+		return fmt.Errorf("unknown config field %q", key)
+	}
+	return err
+}
+
+// Call fn with the path to and value of every field in the config that can be
+// set on its own. Maps and types that parse themselves, like Height, are set
+// as a whole.
+func walkConfig(v reflect.Value, path []string, fn func(field []string, value reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+		fieldPath := append(append([]string{}, path...), field.Name)
+		if _, parses := value.Addr().Interface().(encoding.TextUnmarshaler); value.Kind() == reflect.Struct && !parses {
+			walkConfig(value, fieldPath, fn)
+		} else {
+			fn(fieldPath, value)
+		}
+	}
+}
+
+// Environment variable for a field, e.g. SITDOWN_HARDWARE_UP_PIN for Hardware.UpPin.
+func configEnvName(field []string) string {
+	var name strings.Builder
+	name.WriteString(configEnvPrefix)
+	for i, part := range field {
+		if i > 0 {
+			name.WriteByte('_')
+		}
+		runes := []rune(part)
+		for j, r := range runes {
+			// Start a new word at each capital that follows a lower case letter or
+			// that starts a word after an acronym, like the D in "IDName".
+			if j > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[j-1]) ||
+				(j+1 < len(runes) && unicode.IsLower(runes[j+1]) && unicode.IsUpper(runes[j-1]))) {
+				name.WriteByte('_')
+			}
+			name.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return name.String()
+}
+
+// Set a field from a string. Anything that isn't a plain value, like the presets,
+// is given as JSON.
+func setConfigField(field reflect.Value, value string) error {
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+	default:
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid JSON: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// configOverrides collects repeated -set flags.
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *configOverrides) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+// Add the flags for choosing and overriding the config to flags.
+func addConfigFlags(flags *flag.FlagSet) (*string, *configOverrides) {
+	path := flags.String("config", "", "Read the config from this file instead of looking for "+configFilename)
+	overrides := new(configOverrides)
+	flags.Var(overrides, "set", "Override a config field, e.g. -set Hardware.UpPin=17 (can be repeated)")
+	return path, overrides
+}
+
+// HardwareConfig describes how a controller is wired to its desk and the desk's
+// range. It's read from the "Hardware" section of controller.conf; anything not
+// set there keeps the values for the desks we started with.
+type HardwareConfig struct {
+	// GPIO pins (BCM numbering) wired to the desk's up and down buttons.
+	UpPin   int
+	DownPin int
+
+	SerialPort string
+	BaudRate   uint
+
+	// Name of the DeskProfile for this model of desk.
+	Profile string
+	// Additional profiles, which take precedence over the built in ones.
+	Profiles map[string]DeskProfile
+
+	// Milliseconds the height can go unchanged while the motor is running before
+	// the desk is considered obstructed and stopped (0 to disable).
+	StallWindow int
+	// Inches to reverse after hitting an obstruction (0 to just stop).
+	ObstructionBackoff float32
+
+	// Fraction of DutyCycleWindow (seconds) the motor may run for (0 for no limit).
+	DutyCycle       float64
+	DutyCycleWindow int
+	// Milliseconds the motor may run for in one go before it is stopped regardless.
+	MaxOnTime int
+	// Milliseconds a move may wait for the motor to cool down before it is refused.
+	MaxMoveDelay int
+}
+
+var defaultHardwareConfig = HardwareConfig{
+	UpPin:      16,
+	DownPin:    12,
+	SerialPort: "/dev/serial0",
+	BaudRate:   9600,
+	Profile:    defaultProfileName,
+
+	StallWindow:        750,
+	ObstructionBackoff: 1,
+
+	DutyCycle:       0.1,
+	DutyCycleWindow: 600,
+	MaxOnTime:       20000,
+	MaxMoveDelay:    5000,
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (h HardwareConfig) Validate() error {
+	var problems []string
+	if h.UpPin < 0 || h.UpPin > 27 || h.DownPin < 0 || h.DownPin > 27 {
+		problems = append(problems, "UpPin and DownPin must be GPIO pins between 0 and 27")
+	} else if h.UpPin == h.DownPin {
+		problems = append(problems, "UpPin and DownPin must be different pins")
+	}
+	if h.SerialPort == "" {
+		problems = append(problems, "SerialPort must be set")
+	}
+	if h.BaudRate == 0 {
+		problems = append(problems, "BaudRate must be greater than 0")
+	}
+	if h.StallWindow < 0 {
+		problems = append(problems, "StallWindow must not be negative")
+	} else if h.StallWindow > 0 && h.StallWindow < 200 {
+		problems = append(problems, "StallWindow must be at least 200ms or 0 to disable")
+	}
+	if h.ObstructionBackoff < 0 || h.ObstructionBackoff > 5 {
+		problems = append(problems, "ObstructionBackoff must be between 0 and 5 inches")
+	}
+	if h.DutyCycle < 0 || h.DutyCycle > 1 {
+		problems = append(problems, "DutyCycle must be between 0 and 1")
+	}
+	if h.DutyCycle > 0 && h.DutyCycleWindow <= 0 {
+		problems = append(problems, "DutyCycleWindow must be greater than 0")
+	}
+	if h.MaxOnTime <= 0 {
+		problems = append(problems, "MaxOnTime must be greater than 0")
+	}
+	if h.MaxMoveDelay < 0 {
+		problems = append(problems, "MaxMoveDelay must not be negative")
+	}
+	if profile, ok := h.lookupProfile(); !ok {
+		problems = append(problems, fmt.Sprintf("unknown Profile %q", h.Profile))
+	} else if err := profile.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("Profile %q: %s", h.Profile, err.Error()))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid Hardware config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// DeskProfile returns the profile for the configured model of desk, which is
+// the single source of truth for the desk's height range.
+func (h HardwareConfig) DeskProfile() DeskProfile {
+	profile, _ := h.lookupProfile()
+	return profile
+}
+
+func (h HardwareConfig) lookupProfile() (DeskProfile, bool) {
+	if profile, ok := h.Profiles[h.Profile]; ok {
+		return profile, true
+	}
+	profile, ok := builtinProfiles[h.Profile]
+	return profile, ok
+}
+
+// MotorGuard wraps actuator with the configured motor protection.
+func (h HardwareConfig) MotorGuard(actuator Actuator) *MotorGuard {
+	return NewMotorGuard(actuator, h.DutyCycle,
+		time.Duration(h.DutyCycleWindow)*time.Second,
+		time.Duration(h.MaxOnTime)*time.Millisecond,
+		time.Duration(h.MaxMoveDelay)*time.Millisecond)
+}
+
+func (h HardwareConfig) SerialOptions() serial.OpenOptions {
+	return serial.OpenOptions{
+		PortName:               h.SerialPort,
+		BaudRate:               h.BaudRate,
+		DataBits:               8,
+		StopBits:               1,
+		MinimumReadSize:        0,
+		InterCharacterTimeout:  100,
+		ParityMode:             serial.PARITY_NONE,
+		Rs485Enable:            false,
+		Rs485RtsHighDuringSend: false,
+		Rs485RtsHighAfterSend:  false,
+	}
+}
+
+// Make a change to the config file at path with update, which is given the file's
+// JSON object, leaving anything it doesn't touch as it was.
+func updateConfig(path string, update func(config map[string]interface{})) error {
+	if path == "" {
+		return fmt.Errorf("there is no %s to write to", configFilename)
+	}
+	fileContents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(fileContents, &config); err != nil {
+		return err
+	}
+
+	update(config)
+
+	fileContents, err = json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(fileContents, '\n'), 0644)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigEnvName(t *testing.T) {
+	for _, test := range []struct {
+		field []string
+		want  string
+	}{
+		{[]string{"ID"}, "SITDOWN_ID"},
+		{[]string{"PubKey"}, "SITDOWN_PUB_KEY"},
+		{[]string{"Hardware", "UpPin"}, "SITDOWN_HARDWARE_UP_PIN"},
+		{[]string{"Hardware", "HeightBytes"}, "SITDOWN_HARDWARE_HEIGHT_BYTES"},
+		{[]string{"Messaging", "MQTT", "CAFile"}, "SITDOWN_MESSAGING_MQTT_CA_FILE"},
+		{[]string{"Messaging", "MQTT", "InsecureSkipVerify"}, "SITDOWN_MESSAGING_MQTT_INSECURE_SKIP_VERIFY"},
+		{[]string{"HomeAssistant", "Enabled"}, "SITDOWN_HOME_ASSISTANT_ENABLED"},
+		{[]string{"IDName"}, "SITDOWN_ID_NAME"},
+	} {
+		if got := configEnvName(test.field); got != test.want {
+			t.Errorf("configEnvName(%v) = %s; want %s", test.field, got, test.want)
+		}
+	}
+}
+
+// Each field comes from the file unless the environment sets it, and from -set
+// over both.
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), configFilename)
+	contents := `{
+		"ID": "from-file",
+		"PubKey": "pub",
+		"SubKey": "sub",
+		"Port": 8081,
+		"Messaging": {"Signing": {"SharedKey": "shared"}},
+		"Hardware": {"UpPin": 5, "DownPin": 6}
+	}`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SITDOWN_PORT", "8082")
+	t.Setenv("SITDOWN_HARDWARE_UP_PIN", "7")
+	t.Setenv("SITDOWN_HARDWARE_DOWN_PIN", "8")
+
+	config, loaded, err := LoadConfig(path, []string{"hardware.downpin=9", "Modes.BellToll=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != path {
+		t.Errorf("loaded %s; want %s", loaded, path)
+	}
+	for _, test := range []struct {
+		field     string
+		got, want interface{}
+	}{
+		{"ID, from the file", config.ID, "from-file"},
+		{"Port, from the environment", config.Port, 8082},
+		{"Hardware.UpPin, from the environment", config.Hardware.UpPin, 7},
+		{"Hardware.DownPin, from -set", config.Hardware.DownPin, 9},
+		{"Modes.BellToll, from -set", config.Modes.BellToll, true},
+		{"Hardware.SerialPort, the default", config.Hardware.SerialPort, defaultHardwareConfig.SerialPort},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s = %v; want %v", test.field, test.got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigBadOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), configFilename)
+	if err := os.WriteFile(path, []byte(`{"ID": "desk1", "PubKey": "pub", "SubKey": "sub", "Messaging": {"Signing": {"SharedKey": "shared"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name      string
+		env       string
+		overrides []string
+	}{
+		{name: "unknown field", overrides: []string{"Hardware.Nope=1"}},
+		{name: "no value", overrides: []string{"Port"}},
+		{name: "not a number", overrides: []string{"Port=eighty"}},
+		{name: "invalid after overriding", overrides: []string{"Port=0"}},
+		{name: "bad environment variable", env: "eighty"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv("SITDOWN_PORT", test.env)
+			}
+			if _, _, err := LoadConfig(path, test.overrides); err == nil {
+				t.Error("LoadConfig succeeded")
+			}
+		})
+	}
+}
+
+func TestConfigValidateID(t *testing.T) {
+	for _, test := range []struct {
+		id                  string
+		mqtt, homeAssistant bool
+		valid               bool
+	}{
+		{id: "desk1", valid: true},
+		{id: "desk/1", valid: true},
+		{id: "desk/1", mqtt: true},
+		{id: "desk+", homeAssistant: true},
+		{id: "http"},
+		{id: "BellToll", mqtt: true},
+		// Home Assistant's topics for the desk go next to the transport's.
+		{id: "controller", mqtt: true, valid: true},
+		{id: "controller", homeAssistant: true},
+		{id: "Presence", homeAssistant: true},
+		{id: "presence-desk", homeAssistant: true, valid: true},
+	} {
+		config := defaultConfig()
+		config.ID, config.PubKey, config.SubKey = test.id, "pub", "sub"
+		config.Messaging.Signing.SharedKey = "shared"
+		if test.mqtt {
+			config.Messaging.Transport = transportMQTT
+		}
+		config.HomeAssistant.Enabled = test.homeAssistant
+		if err := config.Validate(); (err == nil) != test.valid {
+			t.Errorf("ID %q (MQTT %t, Home Assistant %t): Validate = %v; want valid %t", test.id, test.mqtt, test.homeAssistant, err, test.valid)
+		}
+	}
+}
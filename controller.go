@@ -2,72 +2,175 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-const configFilename = "controller.conf"
+// Where command mode logs to, unless it's configured to log somewhere other than stderr.
+const commandModeLogFile = "controller.log"
 
 // Controller is the singleton for most of Sitdown's operation. It can be used as a
 // central controller for other desks or the controller to do things with a specific desk.
 type Controller struct {
-	ID     string
-	PubKey string
-	SubKey string
+	Config
+	// Guards Presets.
+	presetMux sync.Mutex
+	// Guards the other settings that can be reloaded while the desk is running.
+	configMux sync.RWMutex
+
+	// Path that the config was loaded from, if there was a file, and the overrides
+	// from the command line, for reloading it.
+	configPath      string
+	configOverrides []string
 
 	// Desk instance used to control the standing desk if running in control mode.
 	desk *Desk
+	// Guards activeControllers, which the subscriber fills in while the prompt reads it.
+	controllersMux sync.Mutex
 	// Map of the IDs of active desk controllers to their IP addresses.
 	activeControllers map[string]string
 
-	// Unbuffered channel specifically for killing bellToll mode.
-	bellTollKill chan bool
+	// Guards bellTollStop and fixedHeight, since commands, Home Assistant and reloads
+	// all switch the modes.
+	modeMux sync.Mutex
+	// Closed to stop bellToll mode, and nil while it's off.
+	bellTollStop chan struct{}
+	// Desk events for fixheight mode, while it's enabled.
+	fixedHeight *Subscription
+	// Record of what the desk has done, if it could be opened.
+	history *HeightHistory
+	// Connection to Home Assistant, if it's enabled.
+	homeAssistant *HomeAssistant
+	// Who may send which commands, if there's a policy file. Guarded by configMux.
+	policy *Policy
 }
 
-func (c *Controller) InitFromConfig() {
-	fileContents, err := ioutil.ReadFile(configFilename)
+// InitFromConfig loads the config from path, or wherever it's found if path is
+// empty, with overrides applied, and exits if it can't be loaded.
+func (c *Controller) InitFromConfig(path string, overrides []string) {
+	config, path, err := LoadConfig(path, overrides)
 	if err != nil {
-		fileContents, err = ioutil.ReadFile("/home/pi/" + configFilename)
-		if err != nil {
-			fmt.Printf("Unable to locate %s in local dir or /home/pi\n", configFilename)
-			os.Exit(1)
-		}
+		fmt.Println("Invalid config:\n" + err.Error())
+		os.Exit(1)
+	}
+	c.Config = config
+	c.configPath, c.configOverrides = path, overrides
+	if err := ConfigureLogging(c.Logging, c.configDir(), c.ID); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	messagingLog.Info("Initializing controller", "id", c.ID, "config", c.configPath)
+	if c.policy, err = c.loadPolicy(c.Config); err != nil {
+		fmt.Println("Invalid policy:\n" + err.Error())
+		os.Exit(1)
 	}
 
-	json.Unmarshal([]byte(fileContents), &c)
-	logger.Printf("Initializing controller with ID: %s\n", c.ID)
-
-	c.desk = new(Desk)
 	c.activeControllers = make(map[string]string)
-	c.bellTollKill = make(chan bool, 1)
+}
+
+// Directory that relative paths in the config are relative to.
+func (c *Controller) configDir() string {
+	if c.configPath == "" {
+		return "."
+	}
+	return filepath.Dir(c.configPath)
+}
+
+// Reload reads the config again and applies the settings that can change while
+// the desk is running: presets, history, analytics, logging, modes and the policy. Changes to
+// anything else are left until sitdown is restarted. Nothing changes if the new
+// config isn't valid.
+func (c *Controller) Reload() error {
+	config, _, err := LoadConfig(c.configPath, c.configOverrides)
+	if err != nil {
+		return err
+	}
+	if config.ID != c.ID || config.PubKey != c.PubKey || config.SubKey != c.SubKey ||
+		config.Port != c.Port || !reflect.DeepEqual(config.Messaging, c.Messaging) || config.HomeAssistant != c.HomeAssistant ||
+		!reflect.DeepEqual(config.Hardware, c.Hardware) {
+		deskLog.Warn("Changes to ID, PubKey, SubKey, Port, Messaging, HomeAssistant or Hardware need a restart to take effect")
+	}
+	policy, err := c.loadPolicy(config)
+	if err != nil {
+		return err
+	}
+	if err := ConfigureLogging(config.Logging, c.configDir(), c.ID); err != nil {
+		return err
+	}
+
+	c.presetMux.Lock()
+	c.Presets = config.Presets
+	c.desk.Events().Publish(PresetsChangedEvent{Names: c.presetNames()})
+	c.presetMux.Unlock()
+
+	c.configMux.Lock()
+	oldModes := c.Modes
+	c.History, c.Analytics, c.Logging, c.Modes = config.History, config.Analytics, config.Logging, config.Modes
+	c.PolicyFile, c.policy = config.PolicyFile, policy
+	c.configMux.Unlock()
+
+	if c.history != nil {
+		if err := c.history.SetConfig(config.History, c.configDir()); err != nil {
+			deskLog.Error("Could not switch history file", "err", err)
+		}
+	}
+	c.applyModes(oldModes, config.Modes)
+	messagingLog.Info("Reloaded config", "config", c.configPath)
+	return nil
+}
+
+// Turn modes on and off where they differ between from and to.
+func (c *Controller) applyModes(from, to ModesConfig) {
+	if to.BellToll != from.BellToll {
+		if to.BellToll {
+			c.EnableBellToll()
+		} else {
+			c.DisableBellToll()
+		}
+	}
+	if to.FixHeight != from.FixHeight {
+		if to.FixHeight == "" {
+			c.DisableFixedHeight()
+		} else if height, err := c.ResolveHeight(to.FixHeight); err != nil {
+			modesLog.Error("Could not enable FixHeight mode", "err", err)
+		} else {
+			c.EnableFixedHeight(height)
+		}
+	}
 }
 
 // Command client mode for communicating with the desk controllers remotely. This is
 // invoked with the -c command line argument from any machine. Does not have to be on
-// the same network since all of the commands are passed through PubNub.
+// the same network if the commands are passed through PubNub.
 //
 // list: Show all controllers that the command client is aware of
+// who: Show the IDs of everything connected to the channel right now
 // exit: Kill the prompt
 // Syntax for anything else (published to controllers): command TARGET [parameters]
 func (c *Controller) EnterCommandMode() {
 	fmt.Println("Entering Command Mode")
-	logFile, err := os.Create("controller.log")
-	if err != nil {
-		fmt.Printf("Could not open controller.log")
-		os.Exit(0)
+	// Log to a file instead of the terminal so that we don't interfere with the prompt.
+	logging := c.Logging
+	if logging.Output == logOutputStderr {
+		logging.Output, logging.File = logOutputFile, commandModeLogFile
+	}
+	if err := ConfigureLogging(logging, ".", c.ID); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	if logging.Output == logOutputFile {
+		fmt.Println("Logging to " + logging.File)
 	}
-	// Reinitialize the logger from stdout so that we don't interfere with the prompt.
-	logger = log.New(logFile, "", log.Ltime)
-	c.ID = CommandClientId
 
 	reader := bufio.NewReader(os.Stdin)
 	messenger.StartSubscriber(c.handleCommandModeMessage)
@@ -83,8 +186,17 @@ loop:
 
 		switch strings.ToLower(action) {
 		case "list":
-			for id, ip := range c.activeControllers {
-				logger.Printf("Controller @ %s (id: %s)]\n", ip, id)
+			for id, ip := range c.knownControllers() {
+				fmt.Printf("Controller @ %s (id: %s)\n", ip, id)
+			}
+			continue
+		case "who":
+			ids, err := messenger.Present()
+			if err != nil {
+				fmt.Println("Could not tell who is connected: " + err.Error())
+			}
+			for _, id := range ids {
+				fmt.Println(id)
 			}
 			continue
 		case "exit":
@@ -92,130 +204,487 @@ loop:
 		}
 
 		if len(splitFullCommand) < 2 {
-			logger.Printf("Command is missing target; skipping")
+			fmt.Println("Command is missing target; skipping")
 			continue
 		}
 
 		target := splitFullCommand[1]
+		if err := checkCommandParams(Command(action), splitFullCommand[2:]); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		var params []string
 		if len(splitFullCommand) > 2 {
-			messenger.Publish(Command(action), "", target, splitFullCommand[2:])
-		} else {
-			messenger.Publish(Command(action), "", target, nil)
+			params = splitFullCommand[2:]
 		}
+		requestID, replies := messenger.Request(Command(action), target, params)
+		c.awaitReplies(fullCommand, requestID, c.commandTargets(target), replies)
 	}
 	os.Exit(0)
 }
 
+// IDs of the controllers that a command for target should get replies from. For
+// everyone, that's the controllers that have announced themselves so far.
+func (c *Controller) commandTargets(target string) []string {
+	if strings.ToLower(target) != broadcastTarget {
+		return []string{target}
+	}
+	controllers := c.knownControllers()
+	targets := make([]string, 0, len(controllers))
+	for id := range controllers {
+		targets = append(targets, id)
+	}
+	return targets
+}
+
+// Catch parameters that the desks would reject before sending them out.
+func checkCommandParams(action Command, params []string) error {
+	switch action {
+	case Set, FixHeight:
+		// Presets live on the desks, so all we can check is that it could be one.
+		if len(params) > 0 && params[0] != "disable" && !validPresetName(params[0]) {
+			_, err := ParseHeight(params[0])
+			return err
+		}
+	case History:
+		now := time.Now()
+		for _, param := range params {
+			if _, err := parseHistoryTime(param, now, now); err != nil {
+				return err
+			}
+		}
+	case LogLevel:
+		if len(params) == 0 {
+			return fmt.Errorf("syntax: loglevel TARGET LEVEL [SUBSYSTEM]")
+		}
+		if _, err := parseLogLevel(params[0]); err != nil {
+			return err
+		}
+		if len(params) > 1 && !validSubsystem(params[1]) {
+			return fmt.Errorf("unknown subsystem %q; expected one of %s", params[1], strings.Join(subsystems, ", "))
+		}
+	case Summary:
+		if len(params) > 0 {
+			if _, err := time.Parse(reportDateLayout, params[0]); err != nil {
+				return fmt.Errorf("invalid date %q; expected YYYY-MM-DD", params[0])
+			}
+		}
+	case Preset:
+		switch {
+		case len(params) == 0:
+			return fmt.Errorf("missing preset action; expected save, delete or list")
+		case params[0] == "save" && len(params) < 3:
+			return fmt.Errorf("syntax: preset TARGET save NAME HEIGHT")
+		case params[0] == "save" && !validPresetName(params[1]):
+			return fmt.Errorf("invalid preset name %q", params[1])
+		case params[0] == "save":
+			_, err := ParseHeight(params[2])
+			return err
+		case params[0] == "delete" && len(params) < 2:
+			return fmt.Errorf("syntax: preset TARGET delete NAME")
+		case params[0] != "delete" && params[0] != "list":
+			return fmt.Errorf("unknown preset action %q; expected save, delete or list", params[0])
+		}
+	}
+	return nil
+}
+
+// Remember a controller that has announced itself.
+func (c *Controller) addController(id, ip string) {
+	c.controllersMux.Lock()
+	defer c.controllersMux.Unlock()
+	c.activeControllers[id] = ip
+}
+
+// A copy of the controllers that have announced themselves so far, by ID.
+func (c *Controller) knownControllers() map[string]string {
+	c.controllersMux.Lock()
+	defer c.controllersMux.Unlock()
+	controllers := make(map[string]string, len(c.activeControllers))
+	for id, ip := range c.activeControllers {
+		controllers[id] = ip
+	}
+	return controllers
+}
+
 // Command handler for messages received while in command mode.
 func (c *Controller) handleCommandModeMessage(message Message) {
 	splitCommand := strings.Split(string(message.Action), " ")
 	switch Command(splitCommand[0]) {
 	case Announce:
-		logger.Printf("Discovered controller %s (id: %s)\n", message.IPAddr, message.ID)
-		c.activeControllers[message.ID] = message.IPAddr
+		messagingLog.Info("Discovered controller", "id", message.ID, "ip", message.IPAddr)
+		c.addController(message.ID, message.IPAddr)
+	case Report:
+		fmt.Printf("\n%s:\n", message.ID)
+		for _, line := range message.Params {
+			fmt.Println("  " + line)
+		}
+		fmt.Print("Command: ")
 	}
 }
 
 // Server mode for processing requests to make a desk do funny things.
 func (c *Controller) EnterDeskControlMode() {
-	c.desk.Setup(logger)
+	c.desk.Setup()
+	history, err := OpenHeightHistory(c.History, c.configDir())
+	if err != nil {
+		deskLog.Error("Not recording history", "err", err)
+	} else {
+		c.history = history
+		go c.history.Run(c.desk.Events().Subscribe())
+	}
+	go metrics.Run(c.desk.Events().Subscribe())
 	messenger.StartAnnouncing()
 	messenger.StartSubscriber(c.handleDeskControllerMessage)
+	if c.HomeAssistant.Enabled {
+		homeAssistant, err := NewHomeAssistant(c.HomeAssistant, c.Messaging.MQTT, c, c.handleDeskControllerMessage)
+		if err != nil {
+			messagingLog.Error("Not publishing to Home Assistant", "err", err)
+		} else {
+			c.homeAssistant = homeAssistant
+			go c.homeAssistant.Run(c.desk.Events().Subscribe())
+		}
+	}
+	c.applyModes(ModesConfig{}, c.Modes)
 }
 
 // Cleanup releases the GPIO resources for controlling the desk. Only needed for desk contol mode.
-func (c Controller) Cleanup() {
-	c.desk.ResetListeners()
+func (c *Controller) Cleanup() {
 	c.desk.Cleanup()
+	if c.history != nil {
+		c.history.Close()
+	}
+	if c.homeAssistant != nil {
+		c.homeAssistant.Close()
+	}
 }
 
-// Command handler that should be running on the actual desk controllers.
+// Command handler that should be running on the actual desk controllers. Senders
+// that gave the command a RequestID are told how it went.
 func (c *Controller) handleDeskControllerMessage(message Message) {
+	cmdLog := messagingLog.With("command", message.Action, "sender", message.ID)
+	reject := func(reason string) {
+		cmdLog.Warn("Rejected command", "reason", reason)
+		messenger.Reply(message, CommandResult{Status: ResultRejected, Reason: reason})
+	}
+	complete := func() {
+		messenger.Reply(message, CommandResult{Status: ResultCompleted})
+	}
+	if err := c.Authorize(message.ID, message.Action, message.Params); err != nil {
+		messenger.Reply(message, CommandResult{Status: ResultRejected, Reason: err.Error()})
+		return
+	}
 	switch Command(message.Action) {
 	case Move:
-		switch len(message.Params) {
-		case 0:
-			logger.Println("Missing parameters in Move command; skipping")
-		case 1:
-			c.Move(message.Params[0], 1000)
-		default:
-			duration, _ := strconv.ParseInt(message.Params[1], 10, 32)
-			c.Move(message.Params[0], int(duration))
+		if len(message.Params) == 0 {
+			reject("missing parameters")
+			return
+		}
+		direction, duration := message.Params[0], 1000
+		if direction != "up" && direction != "down" {
+			reject(fmt.Sprintf("invalid direction %q; expected up or down", direction))
+			return
 		}
+		if len(message.Params) > 1 {
+			parsed, err := strconv.ParseInt(message.Params[1], 10, 32)
+			if err != nil || parsed <= 0 {
+				reject(fmt.Sprintf("invalid duration %q", message.Params[1]))
+				return
+			}
+			duration = int(parsed)
+		}
+		c.runMove(message, func(ctx context.Context) error { return c.Move(ctx, direction, duration) })
 	case Set:
 		if len(message.Params) < 1 {
-			logger.Println("Missing parameters in Set command; skipping")
+			reject("missing parameters")
+		} else if height, err := c.ResolveHeight(message.Params[0]); err != nil {
+			reject(err.Error())
+		} else if err := c.checkHeight(height); err != nil {
+			reject(err.Error())
+		} else {
+			c.runMove(message, func(ctx context.Context) error {
+				err := c.SetHeight(ctx, height)
+				if err != nil {
+					cmdLog.Error("Could not set height", "err", err)
+				}
+				return err
+			})
 		}
-		c.SetHeight(message.Params[0])
+	case Stop:
+		c.Stop()
+		messenger.Reply(message, CommandResult{Status: ResultCompleted, Height: c.GetHeight()})
 	case BellToll:
 		if len(message.Params) < 1 {
-			logger.Println("Missing parameters in BellToll command; skipping")
+			reject("missing parameters")
 		} else if message.Params[0] == "enable" {
-			go c.EnableBellToll()
+			c.EnableBellToll()
+			complete()
 		} else {
 			c.DisableBellToll()
+			complete()
 		}
 	case FixHeight:
 		if len(message.Params) < 1 {
-			logger.Println("Missing parameters in FixHeight command; skipping")
+			reject("missing parameters")
 		} else if message.Params[0] == "disable" {
-			logger.Println("Removing FixedHeightListener from desk")
-			c.desk.ResetListeners()
+			c.DisableFixedHeight()
+			complete()
+		} else if height, err := c.ResolveHeight(message.Params[0]); err != nil {
+			reject(err.Error())
+		} else if err := c.checkHeight(height); err != nil {
+			reject(err.Error())
 		} else {
-			logger.Println("Adding FixedHeightListener to desk")
-			convertedHeight, err := strconv.ParseFloat(message.Params[0], 32)
-			if err != nil {
-				logger.Println("Could not parse height; skipping")
-			} else {
-				c.desk.AddListener(&FixedHeightListener{
-					height:          message.Params[0],
-					convertedHeight: float32(convertedHeight),
-				})
+			c.EnableFixedHeight(height)
+			complete()
+		}
+	case Preset:
+		c.handlePresetCommand(cmdLog, message)
+	case History:
+		c.handleHistoryCommand(cmdLog, message)
+	case Summary:
+		c.handleSummaryCommand(cmdLog, message)
+	case LogLevel:
+		if err := checkCommandParams(LogLevel, message.Params); err != nil {
+			reject(err.Error())
+		} else {
+			subsystem := ""
+			if len(message.Params) > 1 {
+				subsystem = message.Params[1]
 			}
+			SetLogLevel(subsystem, message.Params[0])
+			cmdLog.Info("Changed log level", "subsystem", subsystem, "level", message.Params[0])
+			complete()
 		}
 	case Announce:
-		logger.Printf("Discovered controller %s (id: %s)\n", message.IPAddr, message.ID)
-		c.activeControllers[message.ID] = message.IPAddr
+		cmdLog.Info("Discovered controller", "ip", message.IPAddr)
+		c.addController(message.ID, message.IPAddr)
+	case Report:
+		cmdLog.Debug("Ignoring report")
 	default:
-		logger.Printf("Unrecognized command %v; skipping\n", message.Action)
+		reject("unrecognized command")
+	}
+}
+
+// Run a move from a command in the background so that the subscriber can keep
+// handling messages, like stop, while the desk is moving. The move is tied to
+// CancelMoves now so that a stop also cancels it if it's still waiting its turn.
+// The sender is told the move was accepted now and how it went once it's done.
+func (c *Controller) runMove(message Message, move func(ctx context.Context) error) {
+	metrics.MoveRequested(moveSourceMessage)
+	ctx, cancel := c.desk.WithStop(context.Background())
+	messenger.Reply(message, CommandResult{Status: ResultAccepted})
+	go func() {
+		defer cancel()
+		if err := move(ctx); err != nil {
+			messenger.Reply(message, CommandResult{Status: ResultFailed, Reason: err.Error(), Height: c.GetHeight()})
+		} else {
+			messenger.Reply(message, CommandResult{Status: ResultCompleted, Height: c.GetHeight()})
+		}
+	}()
+}
+
+func (c *Controller) handlePresetCommand(cmdLog *slog.Logger, message Message) {
+	params := message.Params
+	if err := checkCommandParams(Preset, params); err != nil {
+		cmdLog.Warn("Invalid parameters; skipping", "err", err)
+		messenger.Reply(message, CommandResult{Status: ResultRejected, Reason: err.Error()})
+		return
+	}
+	var err error
+	switch params[0] {
+	case "save":
+		height, _ := ParseHeight(params[2])
+		if err = c.SavePreset(params[1], height); err != nil {
+			cmdLog.Error("Could not save preset", "err", err)
+		} else {
+			cmdLog.Info("Saved preset", "name", params[1], "height", height)
+		}
+	case "delete":
+		if err = c.DeletePreset(params[1]); err != nil {
+			cmdLog.Error("Could not delete preset", "err", err)
+		} else {
+			cmdLog.Info("Deleted preset", "name", params[1])
+		}
+	case "list":
+		for _, name := range c.PresetNames() {
+			height, _ := c.Preset(name)
+			cmdLog.Info("Preset", "name", name, "height", height)
+		}
+	}
+	if err != nil {
+		messenger.Reply(message, CommandResult{Status: ResultFailed, Reason: err.Error()})
+	} else {
+		messenger.Reply(message, CommandResult{Status: ResultCompleted})
 	}
 }
 
-func (c *Controller) Move(direction string, time int) {
-	logger.Printf("Moving desk %s for %d", direction, time)
+// Send the most recent history asked for back to whoever asked for it.
+func (c *Controller) handleHistoryCommand(cmdLog *slog.Logger, message Message) {
+	if err := checkCommandParams(History, message.Params); err != nil {
+		cmdLog.Warn("Invalid parameters; skipping", "err", err)
+		messenger.Reply(message, CommandResult{Status: ResultRejected, Reason: err.Error()})
+		return
+	}
+	from, to := "24h", ""
+	if len(message.Params) > 0 {
+		from = message.Params[0]
+	}
+	if len(message.Params) > 1 {
+		to = message.Params[1]
+	}
+	entries, err := c.QueryHistory(from, to)
+	if err != nil {
+		cmdLog.Error("Could not read history", "err", err)
+		messenger.Reply(message, CommandResult{Status: ResultFailed, Reason: err.Error()})
+		return
+	}
+	if len(entries) > historyReportLimit {
+		entries = entries[len(entries)-historyReportLimit:]
+	}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = formatHistoryEntry(entry, func(inches float32) string {
+			return fmt.Sprintf("%.1f", inches)
+		})
+	}
+	messenger.Publish(Report, "", message.ID, lines)
+	messenger.Reply(message, CommandResult{Status: ResultCompleted})
+}
+
+// Send the daily summary asked for back to whoever asked for it.
+func (c *Controller) handleSummaryCommand(cmdLog *slog.Logger, message Message) {
+	date := ""
+	if len(message.Params) > 0 {
+		date = message.Params[0]
+	}
+	report, err := c.DailyReport(date)
+	if err != nil {
+		cmdLog.Error("Could not work out daily report", "err", err)
+		messenger.Reply(message, CommandResult{Status: ResultFailed, Reason: err.Error()})
+		return
+	}
+	messenger.Publish(Report, "", message.ID, report.Summary())
+	messenger.Reply(message, CommandResult{Status: ResultCompleted})
+}
+
+// QueryHistory returns the history between from and to, as understood by
+// parseHistoryTime. from defaults to a day ago and to defaults to now.
+func (c *Controller) QueryHistory(from, to string) ([]HistoryEntry, error) {
+	if c.history == nil {
+		return nil, fmt.Errorf("history is not being recorded")
+	}
+	now := time.Now()
+	fromTime, err := parseHistoryTime(from, now, now.Add(-24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := parseHistoryTime(to, now, now)
+	if err != nil {
+		return nil, err
+	}
+	return c.history.Query(fromTime, toTime)
+}
+
+func (c *Controller) Move(ctx context.Context, direction string, time int) error {
+	deskLog.Info("Moving desk", "direction", direction, "duration", time)
+	var err error
 	switch direction {
 	case "up":
-		c.desk.RaiseForDuration(time)
+		err = c.desk.RaiseForDuration(ctx, time)
 	case "down":
-		c.desk.LowerForDuration(time)
+		err = c.desk.LowerForDuration(ctx, time)
 	}
+	if err != nil {
+		deskLog.Error("Move failed", "direction", direction, "err", err)
+	}
+	return err
 }
 
-func (c *Controller) SetHeight(height string) {
-	logger.Println("Setting height to " + height)
+func (c *Controller) SetHeight(ctx context.Context, height Height) error {
+	deskLog.Info("Setting height", "height", height)
 
-	h, err := strconv.ParseFloat(height, 32)
-	if err != nil || h < 28.1 || h > 47.5 {
-		logger.Printf("Invalid height: %f\n", h)
-		return
+	if err := c.checkHeight(height); err != nil {
+		return err
 	}
-	c.desk.ChangeToHeight(float32(h))
+	result, err := c.desk.ChangeToHeight(ctx, height.Inches())
+	if err != nil {
+		return err
+	}
+	deskLog.Info("Desk "+result.String(), "target", result.Target, "height", result.Height, "duration", result.Duration)
+	if result.TimedOut {
+		return fmt.Errorf("desk %s", result)
+	}
+	return nil
+}
+
+// Returns an error if height is out of the desk's range.
+func (c *Controller) checkHeight(height Height) error {
+	profile := c.Profile()
+	if !profile.Contains(height.Inches()) {
+		return fmt.Errorf("invalid height %s; must be between %s and %s", height,
+			HeightFromInches(profile.MinHeight).In(height.Unit),
+			HeightFromInches(profile.MaxHeight).In(height.Unit))
+	}
+	return nil
+}
+
+// Stop halts the desk, cancelling the move in progress and any waiting to start.
+func (c *Controller) Stop() {
+	deskLog.Info("Stopping desk", "height", c.desk.Height())
+	c.desk.CancelMoves()
+}
+
+// Profile returns the model, and so the range, of the controller's desk.
+func (c *Controller) Profile() DeskProfile {
+	return c.Hardware.DeskProfile()
 }
 
 func (c *Controller) GetHeight() float32 {
 	return c.desk.Height()
 }
 
+// Moves that make one toll of the bell, with their durations in milliseconds.
+var bellTollMoves = []struct {
+	direction string
+	duration  int
+}{{"up", 800}, {"down", 850}}
+
+// EnableBellToll starts tolling the hour by moving the desk up and down, unless
+// it's already tolling.
 func (c *Controller) EnableBellToll() {
-	logger.Println("Enabling BellToll mode")
+	c.modeMux.Lock()
+	defer c.modeMux.Unlock()
+	if c.bellTollStop != nil {
+		return
+	}
+	modesLog.Info("Enabling BellToll mode")
+	c.bellTollStop = make(chan struct{})
+	go c.tollBells(c.bellTollStop)
+	c.desk.Events().Publish(ModeChangedEvent{Mode: string(BellToll), Enabled: true})
+}
+
+func (c *Controller) DisableBellToll() {
+	c.modeMux.Lock()
+	defer c.modeMux.Unlock()
+	if c.bellTollStop == nil {
+		return
+	}
+	modesLog.Info("Disabling BellToll mode")
+	close(c.bellTollStop)
+	c.bellTollStop = nil
+	c.desk.Events().Publish(ModeChangedEvent{Mode: string(BellToll), Enabled: false})
+}
+
+// Toll the hour until stop is closed.
+func (c *Controller) tollBells(stop <-chan struct{}) {
 	// Start tolling at the next hour so the desk doesn't move immediately.
 	// lastTolled := time.Now().Hour() % 12
-loop:
 	for {
 		timer := time.NewTimer(10 * time.Second)
 		select {
-		case <-controller.bellTollKill:
-			break loop
+		case <-stop:
+			timer.Stop()
+			return
 		case <-timer.C:
 			thisHour := time.Now().Hour() % 12
 			// if thisHour == 0 {
@@ -223,12 +692,23 @@ loop:
 			// }
 
 			// if thisHour != lastTolled {
-			log.Printf("Belltoll - %d times", thisHour)
+			modesLog.Info("Tolling the hour", "times", thisHour)
+		toll:
 			for i := 0; i < thisHour; i++ {
-				c.Move("up", 800)
-				time.Sleep(time.Duration(1200) * time.Millisecond)
-				c.Move("down", 850)
-				time.Sleep(time.Duration(1200) * time.Millisecond)
+				for _, move := range bellTollMoves {
+					// Each move is checked so that the policy can stop the toll part way,
+					// e.g. when its hours end or it's reloaded.
+					if err := c.Authorize(string(BellToll), Move, []string{move.direction, strconv.Itoa(move.duration)}); err != nil {
+						break toll
+					}
+					metrics.MoveRequested(moveSourceMode)
+					c.Move(context.Background(), move.direction, move.duration)
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Duration(1200) * time.Millisecond):
+					}
+				}
 			}
 			// lastTolled = thisHour
 			// }
@@ -236,64 +716,64 @@ loop:
 	}
 }
 
-func (c *Controller) DisableBellToll() {
-	logger.Println("Disabling BellToll mode")
-	c.bellTollKill <- true
-}
-
-// FixedHeightListener is a listener that will reset the desk to a configured height.
-type FixedHeightListener struct {
-	EmptyListener
-	height            string
-	convertedHeight   float32
-	chanMutex         sync.Mutex
-	resetKillChannels []chan bool
-}
-
-func (listener *FixedHeightListener) HeightChanged(newHeight float32) {
-	// If we've already kicked off a reset timer then kill it before scheduling a new one.
-	listener.chanMutex.Lock()
-	for _, c := range listener.resetKillChannels {
-		c <- true
+// EnableFixedHeight makes the desk go back to height, after a small delay, whenever
+// it's moved away from it. Replaces any height that was already being held.
+func (c *Controller) EnableFixedHeight(height Height) {
+	modesLog.Info("Enabling FixHeight mode", "height", height)
+	c.modeMux.Lock()
+	if c.fixedHeight != nil {
+		c.fixedHeight.Unsubscribe()
 	}
-	listener.resetKillChannels = make([]chan bool, 0)
-	listener.chanMutex.Unlock()
+	c.fixedHeight = c.desk.Events().Subscribe()
+	go c.holdHeight(c.fixedHeight, height)
+	c.modeMux.Unlock()
+	c.desk.Events().Publish(ModeChangedEvent{Mode: string(FixHeight), Enabled: true})
+}
 
-	// We were just given a value that isn't a multiple of .3; ignore this so that
-	// the desk doesn't just bounce up and down (which is admittedly amusing).
-	if math.Abs(float64(newHeight-listener.convertedHeight)) <= .3 {
+func (c *Controller) DisableFixedHeight() {
+	c.modeMux.Lock()
+	defer c.modeMux.Unlock()
+	if c.fixedHeight == nil {
 		return
 	}
+	modesLog.Info("Disabling FixHeight mode")
+	c.fixedHeight.Unsubscribe()
+	c.fixedHeight = nil
+	c.desk.Events().Publish(ModeChangedEvent{Mode: string(FixHeight), Enabled: false})
+}
 
-	go func() {
-		defer func() {
-			// Prevent this handler blowing up from casuing a panic. This may happen
-			// during shutdown if the listener is running.
-			recover()
-		}()
-
-		randGen := rand.New(rand.NewSource(time.Now().UnixNano()))
-		numSeconds := randGen.Int() % 30
-		if numSeconds < 10 {
-			numSeconds = 10
-		}
-		timer := time.NewTimer(time.Duration(numSeconds) * time.Second)
-		killChannel := make(chan bool, 1)
-
-		// Note that we never remove the channels from the list because they're
-		// unbuffered and will not block the caller or stick around in memory.
-		listener.chanMutex.Lock()
-		listener.resetKillChannels = append(listener.resetKillChannels, killChannel)
-		listener.chanMutex.Unlock()
-
+// Reset the desk to height some time after it last moved away from it, until sub
+// is unsubscribed.
+func (c *Controller) holdHeight(sub *Subscription, height Height) {
+	var reset <-chan time.Time
+	for {
 		select {
-		case <-killChannel:
-			// Do nothing; a new timer is being scheduled.
-		case <-timer.C:
-			logger.Println("Resetting height to " + listener.height)
-			controller.desk.Stop()
-			time.Sleep(1000)
-			controller.SetHeight(listener.height)
+		case event, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			changed, isHeight := event.(HeightChangedEvent)
+			if !isHeight {
+				continue
+			}
+			// We were just given a value that isn't a multiple of .3; ignore this so that
+			// the desk doesn't just bounce up and down (which is admittedly amusing).
+			if math.Abs(float64(changed.Height-height.Inches())) <= .3 {
+				reset = nil
+				continue
+			}
+			// Start the delay over whenever the desk moves so that it isn't reset mid-move.
+			reset = time.After(time.Duration(10+rand.Intn(20)) * time.Second)
+		case <-reset:
+			reset = nil
+			if err := c.Authorize(string(FixHeight), Set, []string{height.String()}); err != nil {
+				continue
+			}
+			modesLog.Info("Resetting height", "height", height)
+			metrics.MoveRequested(moveSourceMode)
+			if err := c.SetHeight(context.Background(), height); err != nil {
+				modesLog.Error("Could not reset height", "err", err)
+			}
 		}
-	}()
+	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A Controller for a simulated desk that has been set up, and is cleaned up
+// after the test.
+func newTestController(t *testing.T) *Controller {
+	t.Helper()
+	profile := defaultHardwareConfig.DeskProfile()
+	sim := NewSimulatedDesk(profile)
+	desk := NewDesk(sim, sim, profile)
+	desk.Setup()
+	t.Cleanup(desk.Cleanup)
+	return &Controller{Config: defaultConfig(), desk: desk, activeControllers: make(map[string]string)}
+}
+
+// The mode changes published on sub until nothing more comes for a while.
+func modeChanges(sub *Subscription) []bool {
+	var changes []bool
+	for {
+		select {
+		case event := <-sub.C():
+			if changed, ok := event.(ModeChangedEvent); ok && changed.Mode == string(BellToll) {
+				changes = append(changes, changed.Enabled)
+			}
+		case <-time.After(200 * time.Millisecond):
+			return changes
+		}
+	}
+}
+
+// Reloads switch belltoll along with commands from elsewhere, like Home Assistant,
+// and none of it may leave the mode stuck or block the reload.
+func TestApplyModesBellToll(t *testing.T) {
+	c := newTestController(t)
+	sub := c.desk.Events().Subscribe()
+	defer sub.Unsubscribe()
+	on, off := ModesConfig{BellToll: true}, ModesConfig{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.applyModes(off, on)
+		// Enabling again, e.g. from Home Assistant, doesn't start a second toll.
+		c.EnableBellToll()
+		c.applyModes(on, off)
+		// Already off, as after a command turned it off before the reload.
+		c.DisableBellToll()
+		c.applyModes(on, off)
+		c.applyModes(off, off)
+		c.applyModes(off, on)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("switching belltoll blocked")
+	}
+
+	if got, want := modeChanges(sub), []bool{true, false, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("belltoll changes = %v; want %v", got, want)
+	}
+	c.modeMux.Lock()
+	running := c.bellTollStop != nil
+	c.modeMux.Unlock()
+	if !running {
+		t.Error("belltoll isn't running after being turned back on")
+	}
+	c.DisableBellToll()
+}
@@ -1,206 +1,261 @@
 package main
 
 import (
-	"github.com/jacobsa/go-serial/serial"
-	"github.com/stianeikeland/go-rpio"
-	"io"
-	"log"
+	"context"
+	"errors"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	maxHeight  int     = 219
-	minHeight  int     = 25
-	baseHeight float32 = 28.1
-)
-
-var serialOptions = serial.OpenOptions{
-	PortName:               "/dev/serial0",
-	BaudRate:               9600,
-	DataBits:               8,
-	StopBits:               1,
-	MinimumReadSize:        0,
-	InterCharacterTimeout:  100,
-	ParityMode:             serial.PARITY_NONE,
-	Rs485Enable:            false,
-	Rs485RtsHighDuringSend: false,
-	Rs485RtsHighAfterSend:  false,
-}
+// Returned by moves that were cut short, or never started, because of CancelMoves.
+var errMoveStopped = errors.New("move stopped")
 
-// Desk is the singleton controller for the GPIO pins that control the desk.
+// Desk is the singleton controller for the hardware that controls the desk.
 type Desk struct {
-	pinButtonUp   rpio.Pin
-	pinButtonDown rpio.Pin
+	actuator Actuator
+	sensor   HeightSensor
 
-	moveMux       *sync.Mutex
-	serialFile    io.ReadWriteCloser
-	currentHeight float32
+	// Holds a value while a move is in progress. A channel rather than a mutex so
+	// that moves waiting for their turn can give up when they're cancelled.
+	moveSlot chan struct{}
+	// Bits of the latest height as a float32, since moves, metrics and Home
+	// Assistant all read it while heightMonitor writes it.
+	currentHeight atomic.Uint32
+	profile       DeskProfile
+	// Latest height from the sensor, for moves that are waiting on the desk.
+	heights chan float32
+	motion  *motionModel
 
-	listeners []DeskListener
+	stallWindow     time.Duration
+	backoffDistance float32
+	// Set if the actuator is wrapped in a MotorGuard.
+	guard *MotorGuard
+
+	stopMux sync.Mutex
+	// Cancelled and replaced by CancelMoves to cancel every move started before then.
+	stopCtx    context.Context
+	cancelStop context.CancelFunc
+
+	events *EventBus
 }
 
-func (d *Desk) Setup(log *log.Logger) {
-	d.pinButtonUp = rpio.Pin(16)
-	d.pinButtonDown = rpio.Pin(12)
-	d.moveMux = new(sync.Mutex)
+// NewDesk creates a Desk that moves with the given actuator and follows its
+// height through sensor. These are usually the Pi's GPIO pins and serial port
+// but can be swapped for a SimulatedDesk. The profile's speeds are the starting
+// point for learning how the desk moves.
+func NewDesk(actuator Actuator, sensor HeightSensor, profile DeskProfile) *Desk {
+	guard, _ := actuator.(*MotorGuard)
+	stopCtx, cancelStop := context.WithCancel(context.Background())
+	return &Desk{
+		guard:      guard,
+		actuator:   actuator,
+		sensor:     sensor,
+		moveSlot:   make(chan struct{}, 1),
+		profile:    profile,
+		heights:    make(chan float32, 1),
+		motion:     newMotionModel(profile),
+		events:     NewEventBus(),
+		stopCtx:    stopCtx,
+		cancelStop: cancelStop,
+	}
+}
 
-	if err := rpio.Open(); err != nil {
+func (d *Desk) Setup() {
+	if err := d.actuator.Setup(); err != nil {
 		panic(err)
 	}
-
-	var err error
-	if d.serialFile, err = serial.Open(serialOptions); err != nil {
+	if err := d.sensor.Setup(); err != nil {
 		panic(err)
 	}
 
 	go d.heightMonitor()
-
-	d.pinButtonUp.Output()
-	d.pinButtonUp.PullUp()
-	d.pinButtonUp.High()
-	d.pinButtonDown.Output()
-	d.pinButtonDown.PullUp()
-	d.pinButtonDown.High()
 }
 
 func (d *Desk) Cleanup() {
-	defer rpio.Close()
-	d.Stop()
-	d.pinButtonUp.PullOff()
-	d.pinButtonDown.PullOff()
+	d.events.Close()
+	d.actuator.Cleanup()
+	d.sensor.Close()
 }
 
-func (d Desk) lock() {
-	d.moveMux.Lock()
+// Wait for any move in progress to finish, or return why ctx was cancelled.
+func (d *Desk) lock(ctx context.Context) error {
+	select {
+	case d.moveSlot <- struct{}{}:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+	// Both may have been ready; don't start a move that has been cancelled.
+	if ctx.Err() != nil {
+		d.unlock()
+		return context.Cause(ctx)
+	}
+	return nil
 }
 
-func (d Desk) unlock() {
-	d.moveMux.Unlock()
+func (d *Desk) unlock() {
+	<-d.moveSlot
 }
 
-func (d Desk) RaiseForDuration(duration int) {
-	d.lock()
-	defer d.unlock()
-	d.raise()
-	sleep(duration)
-	d.Stop()
+// WithStop returns a copy of ctx that is also cancelled, with errMoveStopped as
+// the cause, by the next call to CancelMoves. Moves do this themselves; callers
+// that queue moves up should do it when the move is asked for so that queued
+// moves are cancelled as well.
+func (d *Desk) WithStop(ctx context.Context) (context.Context, context.CancelFunc) {
+	d.stopMux.Lock()
+	stopCtx := d.stopCtx
+	d.stopMux.Unlock()
 
-	for _, listener := range d.listeners {
-		listener.DeskRaised()
+	ctx, cancel := context.WithCancelCause(ctx)
+	unregister := context.AfterFunc(stopCtx, func() {
+		cancel(errMoveStopped)
+	})
+	return ctx, func() {
+		unregister()
+		cancel(context.Canceled)
 	}
 }
 
-func (d Desk) LowerForDuration(duration int) {
-	d.lock()
-	defer d.unlock()
-	d.lower()
-	sleep(duration)
+// CancelMoves stops the desk straight away and fails the move in progress along
+// with any that are waiting for their turn.
+func (d *Desk) CancelMoves() {
+	d.stopMux.Lock()
+	d.cancelStop()
+	d.stopCtx, d.cancelStop = context.WithCancel(context.Background())
+	d.stopMux.Unlock()
 	d.Stop()
+}
 
-	for _, listener := range d.listeners {
-		listener.DeskLowered()
+// RaiseForDuration raises the desk for duration milliseconds, stopping early with
+// an ObstructionError if the desk stops moving before it reaches the top or with
+// the cause if ctx is cancelled.
+func (d *Desk) RaiseForDuration(ctx context.Context, duration int) error {
+	ctx, cancel := d.WithStop(ctx)
+	defer cancel()
+	if err := d.lock(ctx); err != nil {
+		return err
 	}
+	defer d.unlock()
+	if err := d.reserve(ctx, time.Duration(duration)*time.Millisecond); err != nil {
+		return err
+	}
+	err := d.runMotor(ctx, "up", duration)
+
+	d.events.Publish(MovedEvent{Direction: "up", Height: d.Height()})
+	return err
 }
 
-func (d *Desk) ChangeToHeight(height float32) {
-	d.lock()
+// LowerForDuration lowers the desk for duration milliseconds, stopping early with
+// an ObstructionError if the desk stops moving before it reaches the bottom or
+// with the cause if ctx is cancelled.
+func (d *Desk) LowerForDuration(ctx context.Context, duration int) error {
+	ctx, cancel := d.WithStop(ctx)
+	defer cancel()
+	if err := d.lock(ctx); err != nil {
+		return err
+	}
 	defer d.unlock()
-	var acceptableRange float32 = 0.75
-	for math.Abs(float64(height-d.currentHeight)) < float64(acceptableRange) {
-		acceptableRange *= 0.75
+	if err := d.reserve(ctx, time.Duration(duration)*time.Millisecond); err != nil {
+		return err
 	}
-	destLow := height - acceptableRange
-	destHigh := height + acceptableRange
+	err := d.runMotor(ctx, "down", duration)
+
+	d.events.Publish(MovedEvent{Direction: "down", Height: d.Height()})
+	return err
+}
+
+func (d *Desk) runMotor(ctx context.Context, direction string, duration int) error {
+	d.drainHeights()
+	d.start(direction)
+	stall := d.watchForStall()
+	defer stall.Stop()
+	timer := time.NewTimer(time.Duration(duration) * time.Millisecond)
+	defer timer.Stop()
+
 	for {
-		if destLow <= d.currentHeight && d.currentHeight <= destHigh {
+		select {
+		case <-timer.C:
 			d.Stop()
-			for _, listener := range d.listeners {
-				listener.HeightSet(destHigh)
-			}
-			return
-		} else if d.currentHeight > height {
-			d.pinButtonUp.High()
-			d.pinButtonDown.Low()
-		} else if d.currentHeight < height {
-			d.pinButtonDown.High()
-			d.pinButtonUp.Low()
+			return nil
+		case <-d.heights:
+			stall.Moved()
+		case <-stall.C():
+			return d.handleStall(direction)
+		case <-ctx.Done():
+			d.Stop()
+			return context.Cause(ctx)
 		}
 	}
 }
 
-func (d Desk) raise() {
-	d.pinButtonUp.PullDown()
-	d.pinButtonUp.Low()
+// Wait until the MotorGuard, if there is one, allows the motor to run for duration.
+func (d *Desk) reserve(ctx context.Context, duration time.Duration) error {
+	if d.guard == nil {
+		return nil
+	}
+	return d.guard.Reserve(ctx, duration)
+}
+
+// Start the motor going in direction ("up" or "down").
+func (d *Desk) start(direction string) {
+	if direction == "up" {
+		d.actuator.Raise()
+	} else {
+		d.actuator.Lower()
+	}
+	metrics.MotorStarted(direction)
 }
 
-func (d Desk) lower() {
-	d.pinButtonDown.PullDown()
-	d.pinButtonDown.Low()
+func (d *Desk) Stop() {
+	d.actuator.Stop()
+	metrics.MotorStopped()
 }
 
-func (d Desk) Stop() {
-	d.pinButtonUp.PullUp()
-	d.pinButtonUp.High()
-	d.pinButtonDown.PullUp()
-	d.pinButtonDown.High()
+func (d *Desk) Height() float32 {
+	return math.Float32frombits(d.currentHeight.Load())
 }
 
-func (d Desk) Height() float32 {
-	return d.currentHeight
+// FrameStats returns the counts of frames decoded by the height sensor, if it
+// reads frames.
+func (d *Desk) FrameStats() (FrameStats, bool) {
+	if sensor, ok := d.sensor.(interface{ Stats() FrameStats }); ok {
+		return sensor.Stats(), true
+	}
+	return FrameStats{}, false
 }
 
 func (d *Desk) heightMonitor() {
 	for {
-		data := make([]byte, 4)
-		n, err := d.serialFile.Read(data)
-		if n < 4 || err == io.EOF {
-			sleep(50)
+		newHeight, err := d.sensor.ReadHeight()
+		if err == errSensorClosed {
+			return
 		} else if err != nil {
-			panic(err)
-		} else if data[1] == 1 {
-			newHeight := baseHeight + float32(int(data[3])-minHeight)/10
-			if newHeight != d.currentHeight {
-				d.currentHeight = newHeight
-				for _, listener := range d.listeners {
-					listener.HeightChanged(newHeight)
-				}
+			deskLog.Error("Could not read height", "err", err)
+			sleep(1000)
+			continue
+		}
+		if newHeight != d.Height() {
+			d.currentHeight.Store(math.Float32bits(newHeight))
+			// Replace any height a move hasn't picked up yet with the latest one.
+			select {
+			case <-d.heights:
+			default:
 			}
+			select {
+			case d.heights <- newHeight:
+			default:
+			}
+			d.events.Publish(HeightChangedEvent{Height: newHeight})
 		}
 	}
 }
 
-func (d *Desk) AddListener(listener DeskListener) {
-	d.listeners = append(d.listeners, listener)
-}
-
-func (d *Desk) ResetListeners() {
-	d.listeners = nil
+// Events returns the bus that the desk publishes its events on.
+func (d *Desk) Events() *EventBus {
+	return d.events
 }
 
 func sleep(ms int) {
 	time.Sleep(time.Duration(ms) * time.Millisecond)
 }
-
-// DeskListener is an interface for functions that want to be notified of
-// some change of state in the desk.
-type DeskListener interface {
-	// DeskRaised is called when the desk has been raised to a new height.
-	DeskRaised()
-	// DeskRaised is called when the desk has been lowered to a new height.
-	DeskLowered()
-	// HeightSet is called after the desk has been set to a specified height.
-	HeightSet(newHeight float32)
-	// HeightChanged is called on a DeskListener whenever the height of the desk changes.
-	// Note that this is called by the serial stream monitor and will be hit often.
-	HeightChanged(newHeight float32)
-}
-
-// EmptyListener is a no-op listener that can be embedded for convenience.
-type EmptyListener struct{}
-
-func (listener *EmptyListener) DeskRaised()                     {}
-func (listener *EmptyListener) DeskLowered()                    {}
-func (listener *EmptyListener) HeightChanged(newHeight float32) {}
-func (listener *EmptyListener) HeightSet(newHeight float32)     {}
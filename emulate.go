@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stianeikeland/go-rpio"
+	"golang.org/x/term"
+)
+
+const (
+	// Interval between height frames while the motor is running and while idle.
+	emulatorMovingInterval = 50 * time.Millisecond
+	emulatorIdleInterval   = 500 * time.Millisecond
+)
+
+// Emulator pretends to be the desk's controller board. It writes height frames to
+// a pseudo-terminal that sitdown can open in place of /dev/serial0, moving the
+// emulated desk according to the button state it is given.
+type Emulator struct {
+	desk    *SimulatedDesk
+	profile DeskProfile
+	out     io.Writer
+	// Receives "up", "down" or "stop" whenever the button state changes.
+	buttons chan string
+}
+
+func NewEmulator(out io.Writer, profile DeskProfile) *Emulator {
+	return &Emulator{
+		desk:    NewSimulatedDesk(profile),
+		profile: profile,
+		out:     out,
+		buttons: make(chan string, 10),
+	}
+}
+
+// Run writes frames to the emulator's output until it fails.
+func (e *Emulator) Run() error {
+	direction := "stop"
+	lastFrame := time.Now()
+	ticker := time.NewTicker(emulatorMovingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case button := <-e.buttons:
+			if button != "up" && button != "down" {
+				button = "stop"
+			}
+			if button == direction {
+				continue
+			}
+			direction = button
+			switch direction {
+			case "up":
+				e.desk.Raise()
+			case "down":
+				e.desk.Lower()
+			default:
+				e.desk.Stop()
+			}
+			deskLog.Debug("Emulator buttons", "direction", direction)
+		case now := <-ticker.C:
+			if direction == "stop" && now.Sub(lastFrame) < emulatorIdleInterval {
+				continue
+			}
+			lastFrame = now
+			height, _ := e.desk.ReadHeight()
+			if _, err := e.out.Write(e.profile.EncodeHeightFrame(height)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Press updates the emulated button state; valid values are up, down and stop.
+func (e *Emulator) Press(button string) {
+	e.buttons <- button
+}
+
+// Follow button presses written as lines to path (or stdin if path is "-"). A
+// FIFO is reopened each time its writer goes away so that sitdown can restart.
+func (e *Emulator) followButtonFile(path string) {
+	for {
+		var file *os.File
+		if path == "-" {
+			file = os.Stdin
+		} else {
+			var err error
+			if file, err = os.Open(path); err != nil {
+				deskLog.Error("Could not open button file", "err", err)
+				return
+			}
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			button := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if button != "" {
+				e.Press(button)
+			}
+		}
+		e.Press("stop")
+
+		if path == "-" {
+			return
+		}
+		file.Close()
+	}
+}
+
+// Follow the state of the up/down button pins, which are held LOW while pressed.
+// Used when the emulator runs on a Pi wired to the pins of another controller.
+func (e *Emulator) followButtonPins(upPin, downPin int) error {
+	if err := rpio.Open(); err != nil {
+		return err
+	}
+	up, down := rpio.Pin(upPin), rpio.Pin(downPin)
+	up.Input()
+	down.Input()
+
+	go func() {
+		defer rpio.Close()
+		last := "stop"
+		for {
+			current := "stop"
+			if up.Read() == rpio.Low {
+				current = "up"
+			} else if down.Read() == rpio.Low {
+				current = "down"
+			}
+			if current != last {
+				e.Press(current)
+				last = current
+			}
+			sleep(10)
+		}
+	}()
+	return nil
+}
+
+// RunEmulator is the entry point for `sitdown emulate`. It opens a pseudo-terminal,
+// prints the path sitdown should use as its serial port and then writes frames for
+// the desk in controller.conf until killed.
+func RunEmulator(args []string) {
+	flags := flag.NewFlagSet("emulate", flag.ExitOnError)
+	buttonFile := flags.String("buttons", "-", "File or FIFO to read up/down/stop button presses from (- for stdin)")
+	useGPIO := flags.Bool("gpio", false, "Follow the button state of the GPIO pins instead of -buttons")
+	link := flags.String("link", "", "Create a symlink at this path pointing to the emulated serial port")
+	configPath, overrides := addConfigFlags(flags)
+	flags.Parse(args)
+
+	// Emulate the configured desk, so that its profile and pins are the ones sitdown expects.
+	config, _, err := LoadConfig(*configPath, *overrides)
+	if err != nil {
+		fmt.Println("Invalid config:\n" + err.Error())
+		os.Exit(1)
+	}
+
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		fmt.Printf("Could not open pseudo-terminal: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer ptmx.Close()
+	// Keep our own handle to the tty so the port doesn't hang up when sitdown closes it.
+	defer tty.Close()
+	if _, err := term.MakeRaw(int(tty.Fd())); err != nil {
+		fmt.Printf("Could not put pseudo-terminal into raw mode: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	portName := tty.Name()
+	if *link != "" {
+		os.Remove(*link)
+		if err := os.Symlink(portName, *link); err != nil {
+			fmt.Printf("Could not create link: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer os.Remove(*link)
+		portName = *link
+	}
+	fmt.Println(portName)
+
+	hardware := config.Hardware
+	emulator := NewEmulator(ptmx, hardware.DeskProfile())
+	if *useGPIO {
+		if err := emulator.followButtonPins(hardware.UpPin, hardware.DownPin); err != nil {
+			fmt.Printf("Could not open GPIO pins: %s\n", err.Error())
+			os.Exit(1)
+		}
+	} else {
+		go emulator.followButtonFile(*buttonFile)
+	}
+
+	if err := emulator.Run(); err != nil {
+		deskLog.Info("Emulator stopped", "err", err)
+	}
+}
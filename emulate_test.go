@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// A pseudo-terminal standing in for the desk's serial port, closed after the test.
+// Returns the end the desk writes to and the hardware config for the other end.
+func openTestPort(t *testing.T) (*os.File, HardwareConfig) {
+	t.Helper()
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %s", err)
+	}
+	t.Cleanup(func() {
+		ptmx.Close()
+		tty.Close()
+	})
+	if _, err := term.MakeRaw(int(tty.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	hardware := defaultHardwareConfig
+	hardware.SerialPort = tty.Name()
+	return ptmx, hardware
+}
+
+// The emulator's frames should come back out of the serial sensor as the heights
+// of the emulated desk, as they would with sitdown pointed at the emulator's port.
+func TestEmulatorThroughSerialPort(t *testing.T) {
+	ptmx, hardware := openTestPort(t)
+	profile := hardware.DeskProfile()
+	emulator := NewEmulator(ptmx, profile)
+	go emulator.Run()
+
+	sensor := NewSerialHeightSensor(hardware.SerialOptions(), profile)
+	if err := sensor.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer sensor.Close()
+
+	read := func() float32 {
+		t.Helper()
+		heights := make(chan float32, 1)
+		go func() {
+			height, err := sensor.ReadHeight()
+			if err != nil {
+				t.Error(err)
+			}
+			heights <- height
+		}()
+		select {
+		case height := <-heights:
+			return height
+		case <-time.After(5 * time.Second):
+			t.Fatal("no height read from the port")
+			return 0
+		}
+	}
+
+	if height := read(); abs(height-profile.MinHeight) > 0.1 {
+		t.Fatalf("desk starts at %.1f; want %.1f", height, profile.MinHeight)
+	}
+	emulator.Press("up")
+	time.Sleep(time.Second)
+	emulator.Press("stop")
+	// Frames queue up in the port, so read until the raised desk comes through.
+	raised := profile.MinHeight + profile.UpSpeed/2
+	deadline := time.Now().Add(5 * time.Second)
+	height := read()
+	for height < raised && time.Now().Before(deadline) {
+		height = read()
+	}
+	if height < raised || height >= profile.MaxHeight {
+		t.Fatalf("desk at %.1f after raising it for a second from %.1f", height, profile.MinHeight)
+	}
+	if stats := sensor.Stats(); stats.BadFrames != 0 {
+		t.Errorf("%d bad frames", stats.BadFrames)
+	}
+}
+
+// Closing the sensor ends a read that's waiting on a quiet port, which is how the
+// desk's height monitor knows to stop.
+func TestSerialHeightSensorClose(t *testing.T) {
+	_, hardware := openTestPort(t)
+	sensor := NewSerialHeightSensor(hardware.SerialOptions(), hardware.DeskProfile())
+	if err := sensor.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sensor.ReadHeight()
+		errs <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	sensor.Close()
+	select {
+	case err := <-errs:
+		if err != errSensorClosed {
+			t.Errorf("ReadHeight = %v; want %v", err, errSensorClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadHeight didn't return after Close")
+	}
+	if _, err := sensor.ReadHeight(); err != errSensorClosed {
+		t.Errorf("ReadHeight after Close = %v; want %v", err, errSensorClosed)
+	}
+}
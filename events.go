@@ -0,0 +1,140 @@
+package main
+
+import "sync"
+
+// Number of events a subscription holds before the oldest are dropped.
+const subscriptionBuffer = 32
+
+// Event is something that happened to the desk. Subscribers switch on the type
+// to pick out the ones they care about.
+type Event interface {
+	eventName() string
+}
+
+// MovedEvent is sent after the desk has been raised or lowered for a duration.
+type MovedEvent struct {
+	// "up" or "down".
+	Direction string
+	Height    float32
+}
+
+// HeightChangedEvent is sent whenever the sensor reports a new height, which
+// happens often while the desk is moving.
+type HeightChangedEvent struct {
+	Height float32
+}
+
+// TargetReachedEvent is sent after the desk has been moved to a specific height,
+// with where it ended up and how long it took.
+type TargetReachedEvent struct {
+	Result MoveResult
+}
+
+// ObstructedEvent is sent when the desk stopped moving in Direction before it
+// should have and the move was abandoned.
+type ObstructedEvent struct {
+	Direction string
+	Height    float32
+}
+
+// ModeChangedEvent is sent when one of the controller's modes, like belltoll or
+// fixheight, is turned on or off.
+type ModeChangedEvent struct {
+	Mode    string
+	Enabled bool
+}
+
+// PresetsChangedEvent is sent when presets are saved, deleted or reloaded, with
+// the names of the presets there are now.
+type PresetsChangedEvent struct {
+	Names []string
+}
+
+func (MovedEvent) eventName() string          { return "moved" }
+func (HeightChangedEvent) eventName() string  { return "height changed" }
+func (TargetReachedEvent) eventName() string  { return "target reached" }
+func (ObstructedEvent) eventName() string     { return "obstructed" }
+func (ModeChangedEvent) eventName() string    { return "mode changed" }
+func (PresetsChangedEvent) eventName() string { return "presets changed" }
+
+// EventBus delivers events to any number of subscribers. Publishing never blocks:
+// each subscription has its own buffer, and a subscriber that falls behind loses
+// its oldest events rather than holding up the publisher.
+type EventBus struct {
+	mux           sync.Mutex
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscriptions: make(map[*Subscription]struct{})}
+}
+
+// Subscription is a single subscriber's handle on an EventBus.
+type Subscription struct {
+	bus    *EventBus
+	events chan Event
+}
+
+// Subscribe starts delivering events to a new subscription. The subscription
+// is already closed if the bus has been.
+func (b *EventBus) Subscribe() *Subscription {
+	sub := &Subscription{bus: b, events: make(chan Event, subscriptionBuffer)}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.closed {
+		close(sub.events)
+	} else {
+		b.subscriptions[sub] = struct{}{}
+	}
+	return sub
+}
+
+// Publish queues event for every subscriber.
+func (b *EventBus) Publish(event Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for sub := range b.subscriptions {
+		for {
+			select {
+			case sub.events <- event:
+			default:
+				// Full, so make room by dropping the oldest event and try again.
+				select {
+				case <-sub.events:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Close unsubscribes everyone, and any later subscribers, from the bus.
+func (b *EventBus) Close() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for sub := range b.subscriptions {
+		close(sub.events)
+	}
+	b.subscriptions = nil
+	b.closed = true
+}
+
+// C returns the channel that events are delivered on. It's closed once the
+// subscription has been cancelled.
+func (s *Subscription) C() <-chan Event {
+	return s.events
+}
+
+// Unsubscribe stops delivery to the subscription without affecting any others.
+// It's safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mux.Lock()
+	defer s.bus.mux.Unlock()
+	if _, ok := s.bus.subscriptions[s]; ok {
+		delete(s.bus.subscriptions, s)
+		close(s.events)
+	}
+}
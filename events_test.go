@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The events waiting on sub, without blocking.
+func pendingEvents(sub *Subscription) []Event {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-sub.C():
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventBusDelivers(t *testing.T) {
+	bus := NewEventBus()
+	defer bus.Close()
+	first, second := bus.Subscribe(), bus.Subscribe()
+
+	bus.Publish(HeightChangedEvent{Height: 30})
+	bus.Publish(ModeChangedEvent{Mode: string(BellToll), Enabled: true})
+	for _, sub := range []*Subscription{first, second} {
+		events := pendingEvents(sub)
+		if len(events) != 2 || events[0] != (HeightChangedEvent{Height: 30}) || events[1] != (ModeChangedEvent{Mode: string(BellToll), Enabled: true}) {
+			t.Errorf("received %v", events)
+		}
+	}
+}
+
+// A subscriber that falls behind loses its oldest events, and doesn't hold up
+// the publisher or anyone else.
+func TestEventBusDropsOldest(t *testing.T) {
+	bus := NewEventBus()
+	defer bus.Close()
+	slow, other := bus.Subscribe(), bus.Subscribe()
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < subscriptionBuffer+10; i++ {
+			bus.Publish(HeightChangedEvent{Height: float32(i)})
+			// Keep up with other.
+			<-other.C()
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a full subscription")
+	}
+
+	events := pendingEvents(slow)
+	if len(events) != subscriptionBuffer {
+		t.Fatalf("received %d events; want %d", len(events), subscriptionBuffer)
+	}
+	for i, event := range events {
+		if want := (HeightChangedEvent{Height: float32(i + 10)}); event != want {
+			t.Fatalf("event %d = %v; want %v", i, event, want)
+		}
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	defer bus.Close()
+	gone, staying := bus.Subscribe(), bus.Subscribe()
+	bus.Publish(HeightChangedEvent{Height: 30})
+
+	gone.Unsubscribe()
+	gone.Unsubscribe()
+	bus.Publish(HeightChangedEvent{Height: 31})
+
+	// Events from before unsubscribing can still be read before the channel closes.
+	if events := pendingEvents(gone); len(events) != 1 {
+		t.Errorf("unsubscribed subscription received %v", events)
+	}
+	if _, ok := <-gone.C(); ok {
+		t.Error("channel still open after Unsubscribe")
+	}
+	if events := pendingEvents(staying); len(events) != 2 {
+		t.Errorf("other subscription received %v", events)
+	}
+}
+
+func TestEventBusClose(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe()
+	bus.Publish(HeightChangedEvent{Height: 30})
+	bus.Close()
+
+	if events := pendingEvents(sub); len(events) != 1 {
+		t.Errorf("received %v before the close", events)
+	}
+	if _, ok := <-sub.C(); ok {
+		t.Error("channel still open after Close")
+	}
+	// Publishing, subscribing and unsubscribing after closing are all harmless.
+	bus.Publish(HeightChangedEvent{Height: 31})
+	late := bus.Subscribe()
+	if _, ok := <-late.C(); ok {
+		t.Error("subscription after Close is open")
+	}
+	sub.Unsubscribe()
+	late.Unsubscribe()
+}
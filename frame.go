@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Largest change in height (inches) we believe between two consecutive height
+// frames. The desk moves well under 0.2" per frame.
+const maxFrameJump = 2.0
+
+var (
+	errHeightOutOfRange = errors.New("height outside of desk range")
+	errImplausibleJump  = errors.New("height jumped further than the desk can move")
+)
+
+// Frame is a single message from the desk's controller board. Its layout is
+// described by the DeskProfile for the model of desk.
+type Frame []byte
+
+// FrameStats counts what a FrameDecoder has seen so far. The counts are updated
+// atomically so that they can be read while the decoder is running with Load.
+type FrameStats struct {
+	// Frames that passed validation and were returned to the caller.
+	Frames uint64
+	// Frames that were well formed but failed validation.
+	BadFrames uint64
+	// Bytes thrown away while searching for a frame header.
+	SkippedBytes uint64
+}
+
+// Load returns a copy of the counts that is safe to take while they're changing.
+func (s *FrameStats) Load() FrameStats {
+	return FrameStats{
+		Frames:       atomic.LoadUint64(&s.Frames),
+		BadFrames:    atomic.LoadUint64(&s.BadFrames),
+		SkippedBytes: atomic.LoadUint64(&s.SkippedBytes),
+	}
+}
+
+// FrameDecoder reads frames out of a byte stream from the desk. Bytes that don't
+// line up with a frame header are skipped until the decoder finds two headers a
+// frame apart, so a dropped or corrupted byte only costs the frames around it.
+// Height frames are checked for plausibility before being returned. Without a
+// header there's nothing to sync on, so frames are simply taken in turn.
+type FrameDecoder struct {
+	reader  io.Reader
+	profile DeskProfile
+	buf     []byte
+	synced  bool
+
+	// Height of the last accepted height frame, if there is one.
+	lastHeight    float32
+	hasLastHeight bool
+	// Height of a rejected jump; accepted if the next frame agrees with it.
+	candidateHeight float32
+	hasCandidate    bool
+
+	Stats FrameStats
+}
+
+func NewFrameDecoder(reader io.Reader, profile DeskProfile) *FrameDecoder {
+	return &FrameDecoder{
+		reader:  reader,
+		profile: profile,
+	}
+}
+
+// Next returns the next valid frame in the stream. Partial frames are kept between
+// calls, so an io.EOF from the underlying reader (which the serial port returns
+// when it times out) can be retried without losing data.
+func (d *FrameDecoder) Next() (Frame, error) {
+	for {
+		// Until we're in sync we want to see where the following frame starts too.
+		frameLen := d.profile.FrameLength
+		need := frameLen
+		if !d.synced {
+			need = frameLen + len(d.profile.Header)
+		}
+		if len(d.buf) < need {
+			if err := d.fill(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !d.hasHeaderAt(0) || (!d.synced && !d.hasHeaderAt(frameLen)) {
+			d.synced = false
+			d.buf = d.buf[1:]
+			atomic.AddUint64(&d.Stats.SkippedBytes, 1)
+			continue
+		}
+
+		frame := make(Frame, frameLen)
+		copy(frame, d.buf)
+		d.buf = d.buf[frameLen:]
+		d.synced = true
+
+		if err := d.validate(frame); err != nil {
+			atomic.AddUint64(&d.Stats.BadFrames, 1)
+			deskLog.Debug("Discarding frame", "frame", fmt.Sprintf("% x", []byte(frame)), "err", err)
+			continue
+		}
+		atomic.AddUint64(&d.Stats.Frames, 1)
+		return frame, nil
+	}
+}
+
+// Height converts the raw height in a height frame to inches.
+func (d *FrameDecoder) Height(frame Frame) float32 {
+	return d.profile.Height(d.profile.RawHeight(frame))
+}
+
+func (d *FrameDecoder) hasHeaderAt(i int) bool {
+	return bytes.HasPrefix(d.buf[i:], d.profile.Header)
+}
+
+func (d *FrameDecoder) fill() error {
+	data := make([]byte, 64)
+	n, err := d.reader.Read(data)
+	d.buf = append(d.buf, data[:n]...)
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+func (d *FrameDecoder) validate(frame Frame) error {
+	if !d.profile.IsHeightFrame(frame) {
+		return nil
+	}
+
+	height := d.Height(frame)
+	if !d.profile.Contains(height) {
+		return errHeightOutOfRange
+	}
+	if d.hasLastHeight && abs(height-d.lastHeight) > maxFrameJump {
+		// A single wild value is probably corruption, but if the next frame backs
+		// it up then the desk really is there (e.g. it moved while we were down).
+		if !d.hasCandidate || abs(height-d.candidateHeight) > maxFrameJump {
+			d.candidateHeight, d.hasCandidate = height, true
+			return errImplausibleJump
+		}
+	}
+	d.lastHeight, d.hasLastHeight = height, true
+	d.hasCandidate = false
+	return nil
+}
+
+func abs(n float32) float32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Frames laid out like the default desk's, but starting with a header to sync on.
+var headerProfile = func() DeskProfile {
+	profile := builtinProfiles[defaultProfileName]
+	profile.Header = HexBytes{0x98}
+	return profile
+}()
+
+// Hand-built streams for headerProfile, with the damage the decoder has to cope
+// with. 98 01 00 64 is a height frame for 35.6"; 98 00 00 00 is a frame that
+// doesn't carry a height.
+var frameStreams = []struct {
+	name   string
+	stream string
+	// Heights of the height frames that should come out, in order.
+	heights []float32
+	// Frames that don't carry a height that should come out.
+	others  int
+	bad     uint64
+	skipped uint64
+}{
+	{
+		name:    "clean",
+		stream:  "98 01 00 64  98 00 00 00  98 01 00 65  98 01 00 66",
+		heights: []float32{35.6, 35.7, 35.8},
+		others:  1,
+	},
+	{
+		name:    "starts mid-frame",
+		stream:  "00 65  98 01 00 64  98 01 00 65",
+		heights: []float32{35.6, 35.7},
+		skipped: 2,
+	},
+	{
+		name:    "header byte inside the partial frame",
+		stream:  "01 98 64  98 01 00 64  98 01 00 65",
+		heights: []float32{35.6, 35.7},
+		skipped: 3,
+	},
+	{
+		// The byte after the dropped one is read as a height, which is implausible,
+		// and the decoder loses sync until the next frame boundary.
+		name:    "dropped byte",
+		stream:  "98 01 00 64  98 01 64  98 01 00 66  98 01 00 67  98 01 00 68",
+		heights: []float32{35.6, 35.9, 36.0},
+		bad:     1,
+		skipped: 3,
+	},
+	{
+		// Until the decoder is in sync, a frame only counts if another header follows it.
+		name:    "corrupt header before sync",
+		stream:  "98 01 00 64  99 01 00 65  98 01 00 66  98 01 00 67",
+		heights: []float32{35.8, 35.9},
+		skipped: 8,
+	},
+	{
+		name:    "corrupt header",
+		stream:  "98 01 00 63  98 01 00 64  99 01 00 65  98 01 00 66  98 01 00 67",
+		heights: []float32{35.5, 35.6, 35.8, 35.9},
+		skipped: 4,
+	},
+	{
+		name:    "height above the desk's range",
+		stream:  "98 01 00 64  98 01 00 ff  98 01 00 65",
+		heights: []float32{35.6, 35.7},
+		bad:     1,
+	},
+	{
+		name:    "height below the desk's range",
+		stream:  "98 01 00 64  98 01 00 02  98 01 00 65",
+		heights: []float32{35.6, 35.7},
+		bad:     1,
+	},
+	{
+		name:    "single implausible jump",
+		stream:  "98 01 00 64  98 01 00 c8  98 01 00 65",
+		heights: []float32{35.6, 35.7},
+		bad:     1,
+	},
+	{
+		// Two frames that agree mean the desk really is there.
+		name:    "jump confirmed by the next frame",
+		stream:  "98 01 00 64  98 01 00 c8  98 01 00 c9  98 01 00 ca",
+		heights: []float32{35.6, 45.7, 45.8},
+		bad:     1,
+	},
+	{
+		name:    "garbage between frames",
+		stream:  "98 01 00 63  98 01 00 64  ff ff 00 98 12  98 01 00 65  98 01 00 66",
+		heights: []float32{35.5, 35.6, 35.7, 35.8},
+		skipped: 5,
+	},
+}
+
+func decodeHex(t testing.TB, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// timeoutReader returns its data a few bytes at a time with an io.EOF after each
+// read, like the serial port does when a read times out part way through a frame.
+type timeoutReader struct {
+	data    []byte
+	chunk   int
+	timeout bool
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	r.timeout = !r.timeout
+	if r.timeout || len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.chunk)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *timeoutReader) done() bool {
+	return len(r.data) == 0
+}
+
+// Decode everything from reader, retrying on io.EOF until finished says the
+// stream is used up. Returns the heights and the count of other frames.
+func decodeAll(t testing.TB, decoder *FrameDecoder, finished func() bool) ([]float32, int) {
+	t.Helper()
+	var heights []float32
+	others := 0
+	for {
+		frame, err := decoder.Next()
+		if err == io.EOF {
+			if finished() {
+				return heights, others
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if decoder.profile.IsHeightFrame(frame) {
+			heights = append(heights, decoder.Height(frame))
+		} else {
+			others++
+		}
+	}
+}
+
+func TestFrameDecoder(t *testing.T) {
+	profile := headerProfile
+	readers := map[string]func([]byte) (io.Reader, func() bool){
+		"whole": func(data []byte) (io.Reader, func() bool) {
+			return bytes.NewReader(data), func() bool { return true }
+		},
+		"one byte at a time": func(data []byte) (io.Reader, func() bool) {
+			return iotest.OneByteReader(bytes.NewReader(data)), func() bool { return true }
+		},
+		"short reads with timeouts": func(data []byte) (io.Reader, func() bool) {
+			reader := &timeoutReader{data: data, chunk: 3}
+			return reader, reader.done
+		},
+	}
+
+	for _, test := range frameStreams {
+		for readerName, newReader := range readers {
+			t.Run(test.name+"/"+readerName, func(t *testing.T) {
+				reader, finished := newReader(decodeHex(t, test.stream))
+				decoder := NewFrameDecoder(reader, profile)
+				heights, others := decodeAll(t, decoder, finished)
+
+				if len(heights) != len(test.heights) {
+					t.Fatalf("heights = %v; want %v", heights, test.heights)
+				}
+				for i := range heights {
+					if abs(heights[i]-test.heights[i]) > 0.01 {
+						t.Fatalf("heights = %v; want %v", heights, test.heights)
+					}
+				}
+				if others != test.others {
+					t.Errorf("other frames = %d; want %d", others, test.others)
+				}
+				stats := decoder.Stats.Load()
+				if stats.Frames != uint64(len(test.heights)+test.others) {
+					t.Errorf("Frames = %d; want %d", stats.Frames, len(test.heights)+test.others)
+				}
+				if stats.BadFrames != test.bad {
+					t.Errorf("BadFrames = %d; want %d", stats.BadFrames, test.bad)
+				}
+				if stats.SkippedBytes != test.skipped {
+					t.Errorf("SkippedBytes = %d; want %d", stats.SkippedBytes, test.skipped)
+				}
+			})
+		}
+	}
+}
+
+// The default desk's frames have no header, so they're read 4 bytes at a time as
+// sitdown always has.
+func TestFrameDecoderWithoutHeader(t *testing.T) {
+	stream := decodeHex(t, "00 01 00 64  00 00 00 00  98 01 00 65  00 01 00 ff  00 01 00 66")
+	decoder := NewFrameDecoder(iotest.OneByteReader(bytes.NewReader(stream)), builtinProfiles[defaultProfileName])
+	heights, others := decodeAll(t, decoder, func() bool { return true })
+	if len(heights) != 3 || abs(heights[0]-35.6) > 0.01 || abs(heights[1]-35.7) > 0.01 || abs(heights[2]-35.8) > 0.01 {
+		t.Errorf("heights = %v; want [35.6 35.7 35.8]", heights)
+	}
+	if others != 1 {
+		t.Errorf("other frames = %d; want 1", others)
+	}
+	if stats := decoder.Stats.Load(); stats.BadFrames != 1 || stats.SkippedBytes != 0 {
+		t.Errorf("BadFrames = %d, SkippedBytes = %d; want 1 and 0", stats.BadFrames, stats.SkippedBytes)
+	}
+}
+
+// Whatever comes before them, a run of good frames should get the decoder back in
+// sync and out the other end.
+func FuzzFrameDecoder(f *testing.F) {
+	for _, test := range frameStreams {
+		f.Add(decodeHex(f, test.stream))
+	}
+	f.Add([]byte{0x98, 0x98, 0x98, 0x98, 0x98})
+	f.Add([]byte{0x98, 0x01, 0x00})
+
+	profile := headerProfile
+	good := profile.EncodeHeightFrame(35.6)
+	f.Fuzz(func(t *testing.T, garbage []byte) {
+		stream := append([]byte{}, garbage...)
+		for i := 0; i < 4; i++ {
+			stream = append(stream, good...)
+		}
+		decoder := NewFrameDecoder(bytes.NewReader(stream), profile)
+		heights, _ := decodeAll(t, decoder, func() bool { return true })
+
+		if len(heights) == 0 || abs(heights[len(heights)-1]-35.6) > 0.01 {
+			t.Fatalf("didn't resync; heights %v from % x", heights, stream)
+		}
+		stats := decoder.Stats.Load()
+		if stats.SkippedBytes > uint64(len(stream)) {
+			t.Fatalf("skipped %d bytes of %d", stats.SkippedBytes, len(stream))
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/jacobsa/go-serial/serial"
+	"github.com/stianeikeland/go-rpio"
+)
+
+// Returned by a HeightSensor once it has been closed.
+var errSensorClosed = errors.New("height sensor closed")
+
+// Actuator is the motor side of a desk: something that can be told to start
+// raising, start lowering or stop.
+type Actuator interface {
+	Setup() error
+	Raise()
+	Lower()
+	Stop()
+	Cleanup()
+}
+
+// HeightSensor is the feedback side of a desk. ReadHeight blocks until the next
+// reading is available; the same height may be reported more than once.
+type HeightSensor interface {
+	Setup() error
+	ReadHeight() (float32, error)
+	Close() error
+}
+
+// PiActuator drives the desk's up/down buttons through two GPIO pins on a
+// Raspberry Pi. Pulling a pin LOW is the equivalent of holding the button.
+type PiActuator struct {
+	pinButtonUp   rpio.Pin
+	pinButtonDown rpio.Pin
+}
+
+func NewPiActuator(upPin, downPin int) *PiActuator {
+	return &PiActuator{
+		pinButtonUp:   rpio.Pin(upPin),
+		pinButtonDown: rpio.Pin(downPin),
+	}
+}
+
+func (a *PiActuator) Setup() error {
+	if err := rpio.Open(); err != nil {
+		return err
+	}
+	a.pinButtonUp.Output()
+	a.pinButtonUp.PullUp()
+	a.pinButtonUp.High()
+	a.pinButtonDown.Output()
+	a.pinButtonDown.PullUp()
+	a.pinButtonDown.High()
+	return nil
+}
+
+func (a *PiActuator) Raise() {
+	a.pinButtonDown.PullUp()
+	a.pinButtonDown.High()
+	a.pinButtonUp.PullDown()
+	a.pinButtonUp.Low()
+}
+
+func (a *PiActuator) Lower() {
+	a.pinButtonUp.PullUp()
+	a.pinButtonUp.High()
+	a.pinButtonDown.PullDown()
+	a.pinButtonDown.Low()
+}
+
+func (a *PiActuator) Stop() {
+	a.pinButtonUp.PullUp()
+	a.pinButtonUp.High()
+	a.pinButtonDown.PullUp()
+	a.pinButtonDown.High()
+}
+
+func (a *PiActuator) Cleanup() {
+	defer rpio.Close()
+	a.Stop()
+	a.pinButtonUp.PullOff()
+	a.pinButtonDown.PullOff()
+}
+
+// NopActuator is an Actuator that doesn't drive anything, for replaying recordings
+// on a machine without the desk's pins, where presses wouldn't change the heights anyway.
+type NopActuator struct{}
+
+func (NopActuator) Setup() error { return nil }
+func (NopActuator) Raise()       {}
+func (NopActuator) Lower()       {}
+func (NopActuator) Stop()        {}
+func (NopActuator) Cleanup()     {}
+
+// ButtonFileActuator writes button presses as "up", "down" or "stop" lines to a
+// file instead of driving GPIO pins. Pointing it at the FIFO that `sitdown emulate`
+// reads from lets the real serial path be exercised without a Pi.
+type ButtonFileActuator struct {
+	path string
+	file *os.File
+	// Last button written, so that holding a button doesn't flood the file.
+	last string
+}
+
+func NewButtonFileActuator(path string) *ButtonFileActuator {
+	return &ButtonFileActuator{path: path}
+}
+
+func (a *ButtonFileActuator) Setup() error {
+	var err error
+	a.file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return err
+}
+
+func (a *ButtonFileActuator) Raise() { a.press("up") }
+func (a *ButtonFileActuator) Lower() { a.press("down") }
+func (a *ButtonFileActuator) Stop()  { a.press("stop") }
+
+func (a *ButtonFileActuator) Cleanup() {
+	if a.file != nil {
+		a.Stop()
+		a.file.Close()
+	}
+}
+
+func (a *ButtonFileActuator) press(button string) {
+	if button == a.last {
+		return
+	}
+	a.last = button
+	if _, err := fmt.Fprintln(a.file, button); err != nil {
+		deskLog.Error("Could not write button press", "err", err)
+	}
+}
+
+// SerialHeightSensor reads the height frames that the desk's controller board
+// writes to the Pi's UART.
+type SerialHeightSensor struct {
+	// If set, the raw byte stream from the port is recorded to this file.
+	CaptureFile string
+
+	options     serial.OpenOptions
+	profile     DeskProfile
+	serialFile  io.ReadWriteCloser
+	captureFile *os.File
+	decoder     *FrameDecoder
+	// Set by Close, after which reads from the port fail however they fail.
+	closed atomic.Bool
+}
+
+func NewSerialHeightSensor(options serial.OpenOptions, profile DeskProfile) *SerialHeightSensor {
+	return &SerialHeightSensor{options: options, profile: profile}
+}
+
+func (s *SerialHeightSensor) Setup() error {
+	var err error
+	if s.serialFile, err = serial.Open(s.options); err != nil {
+		return err
+	}
+
+	var reader io.Reader = s.serialFile
+	if s.CaptureFile != "" {
+		if s.captureFile, err = os.Create(s.CaptureFile); err != nil {
+			return err
+		}
+		deskLog.Info("Capturing serial stream", "file", s.CaptureFile)
+		reader = newCaptureReader(reader, s.captureFile)
+	}
+	s.decoder = NewFrameDecoder(reader, s.profile)
+	return nil
+}
+
+// ReadHeight blocks until a height frame has been read from the port, or returns
+// errSensorClosed once the sensor has been closed.
+func (s *SerialHeightSensor) ReadHeight() (float32, error) {
+	if s.closed.Load() {
+		return 0, errSensorClosed
+	}
+	height, err := readHeight(s.decoder)
+	if err != nil && s.closed.Load() {
+		return 0, errSensorClosed
+	}
+	return height, err
+}
+
+// Read frames until one carrying a height comes along. Frames that don't carry
+// a height are skipped.
+func readHeight(decoder *FrameDecoder) (float32, error) {
+	for {
+		frame, err := decoder.Next()
+		if err == io.EOF {
+			// The port returns EOF when nothing arrives within the read timeout.
+			sleep(50)
+		} else if err != nil {
+			return 0, err
+		} else if decoder.profile.IsHeightFrame(frame) {
+			return decoder.Height(frame), nil
+		}
+	}
+}
+
+// Stats returns the counts of frames decoded from the port so far.
+func (s *SerialHeightSensor) Stats() FrameStats {
+	if s.decoder == nil {
+		return FrameStats{}
+	}
+	return s.decoder.Stats.Load()
+}
+
+func (s *SerialHeightSensor) Close() error {
+	s.closed.Store(true)
+	if s.captureFile != nil {
+		s.captureFile.Close()
+	}
+	if s.serialFile == nil {
+		return nil
+	}
+	return s.serialFile.Close()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The history file has one line per entry: the time in Unix milliseconds, the
+// kind of entry and the height in inches, followed by the target for set entries.
+//
+//	1760680800000 height 29.4
+//	1760680803120 set 43.0 43.1
+
+// Kinds of history entries.
+const (
+	// The height reported by the desk changed.
+	historyHeight = "height"
+	// The desk was raised or lowered for a duration.
+	historyUp   = "up"
+	historyDown = "down"
+	// The desk was moved to a specific height.
+	historySet = "set"
+	// A move was abandoned because the desk was obstructed.
+	historyObstructed = "obstructed"
+)
+
+// How often the history file is trimmed to the retention limits.
+const historyCompactInterval = time.Hour
+
+// HistoryConfig controls where the height history is kept and for how long.
+// It's read from the "History" section of controller.conf.
+type HistoryConfig struct {
+	// Path of the history file. Relative paths are relative to controller.conf.
+	File string
+	// Days of history to keep.
+	Retention int
+	// Hours after which height changes are thinned out to one per Resolution
+	// seconds. Moves are kept for the whole retention period.
+	DownsampleAfter int
+	Resolution      int
+}
+
+var defaultHistoryConfig = HistoryConfig{
+	File:            "history.log",
+	Retention:       30,
+	DownsampleAfter: 24,
+	Resolution:      60,
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (h HistoryConfig) Validate() error {
+	var problems []string
+	if h.File == "" {
+		problems = append(problems, "File must be set")
+	}
+	if h.Retention <= 0 {
+		problems = append(problems, "Retention must be at least 1 day")
+	}
+	if h.DownsampleAfter < 0 {
+		problems = append(problems, "DownsampleAfter must not be negative")
+	}
+	if h.Resolution <= 0 {
+		problems = append(problems, "Resolution must be greater than 0")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid History config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// HistoryEntry is a single point in a desk's height history.
+type HistoryEntry struct {
+	Time   time.Time
+	Kind   string
+	Height float32
+	// Height that was asked for, only for set entries.
+	Target float32
+}
+
+func (e HistoryEntry) encode() string {
+	line := fmt.Sprintf("%d %s %.1f", e.Time.UnixMilli(), e.Kind, e.Height)
+	if e.Kind == historySet {
+		line += fmt.Sprintf(" %.1f", e.Target)
+	}
+	return line
+}
+
+func decodeHistoryEntry(line string) (HistoryEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return HistoryEntry{}, fmt.Errorf("malformed history entry %q", line)
+	}
+	millis, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("malformed history entry %q", line)
+	}
+	height, err := strconv.ParseFloat(fields[2], 32)
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("malformed history entry %q", line)
+	}
+	entry := HistoryEntry{Time: time.UnixMilli(millis), Kind: fields[1], Height: float32(height)}
+	if len(fields) > 3 {
+		target, err := strconv.ParseFloat(fields[3], 32)
+		if err != nil {
+			return HistoryEntry{}, fmt.Errorf("malformed history entry %q", line)
+		}
+		entry.Target = float32(target)
+	}
+	return entry, nil
+}
+
+// HeightHistory records what the desk does to a file so that it can be looked
+// at later, e.g. to see what happened to a desk overnight.
+type HeightHistory struct {
+	config HistoryConfig
+	path   string
+
+	mux  sync.Mutex
+	file *os.File
+}
+
+// OpenHeightHistory opens the history file for config, creating it if needed.
+// Relative paths are taken to be relative to dir.
+func OpenHeightHistory(config HistoryConfig, dir string) (*HeightHistory, error) {
+	path := config.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	h := &HeightHistory{config: config, path: path}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// SetConfig changes the retention limits, and moves to a new file if the path
+// has changed. The old file is left where it is.
+func (h *HeightHistory) SetConfig(config HistoryConfig, dir string) error {
+	path := config.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.config = config
+	if path == h.path {
+		return nil
+	}
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	h.path = path
+	return h.open()
+}
+
+func (h *HeightHistory) open() error {
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open history: %s", err.Error())
+	}
+	h.file = file
+	return nil
+}
+
+// Run records the desk's events from sub until it is unsubscribed, trimming the
+// history to the retention limits as it goes.
+func (h *HeightHistory) Run(sub *Subscription) {
+	h.Compact()
+	ticker := time.NewTicker(historyCompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if entry, ok := historyEntryFor(event); ok {
+				h.Record(entry)
+			}
+		case <-ticker.C:
+			h.Compact()
+		}
+	}
+}
+
+// The entry to record for event, if it's one worth keeping.
+func historyEntryFor(event Event) (HistoryEntry, bool) {
+	entry := HistoryEntry{Time: time.Now()}
+	switch e := event.(type) {
+	case HeightChangedEvent:
+		entry.Kind, entry.Height = historyHeight, e.Height
+	case MovedEvent:
+		entry.Kind, entry.Height = historyDown, e.Height
+		if e.Direction == "up" {
+			entry.Kind = historyUp
+		}
+	case TargetReachedEvent:
+		entry.Kind, entry.Height, entry.Target = historySet, e.Result.Height, e.Result.Target
+	case ObstructedEvent:
+		entry.Kind, entry.Height = historyObstructed, e.Height
+	default:
+		return entry, false
+	}
+	return entry, true
+}
+
+// Record adds entry to the end of the history.
+func (h *HeightHistory) Record(entry HistoryEntry) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.file == nil {
+		return
+	}
+	if _, err := fmt.Fprintln(h.file, entry.encode()); err != nil {
+		deskLog.Error("Could not write to history", "err", err)
+	}
+}
+
+// Query returns the entries from between from and to, oldest first.
+func (h *HeightHistory) Query(from, to time.Time) ([]HistoryEntry, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	var entries []HistoryEntry
+	err := h.read(func(entry HistoryEntry) {
+		if !entry.Time.Before(from) && !entry.Time.After(to) {
+			entries = append(entries, entry)
+		}
+	})
+	return entries, err
+}
+
+// Last returns the most recent entry from before before, however old, and false
+// if there isn't one.
+func (h *HeightHistory) Last(before time.Time) (HistoryEntry, bool, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	var last HistoryEntry
+	found := false
+	err := h.read(func(entry HistoryEntry) {
+		if entry.Time.Before(before) && (!found || !entry.Time.Before(last.Time)) {
+			last, found = entry, true
+		}
+	})
+	return last, found, err
+}
+
+// Read every entry in the file. Must be called with mux held.
+func (h *HeightHistory) read(fn func(HistoryEntry)) error {
+	file, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("could not read history: %s", err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry, err := decodeHistoryEntry(scanner.Text())
+		if err != nil {
+			// Most likely a line cut short by a power cut; the rest is still good.
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// Compact drops entries older than the retention period and thins out old height
+// changes to one per Resolution seconds, keeping the last in each interval. The
+// newest entry from before the retention period is kept so that where the desk
+// was is never forgotten, however long it has been left alone.
+func (h *HeightHistory) Compact() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	now := time.Now()
+	oldest := now.AddDate(0, 0, -h.config.Retention)
+	downsampleBefore := now.Add(-time.Duration(h.config.DownsampleAfter) * time.Hour)
+	resolution := time.Duration(h.config.Resolution) * time.Second
+
+	var kept []HistoryEntry
+	var expired *HistoryEntry
+	err := h.read(func(entry HistoryEntry) {
+		if entry.Time.Before(oldest) {
+			expired = &entry
+			return
+		}
+		if entry.Kind == historyHeight && entry.Time.Before(downsampleBefore) && len(kept) > 0 {
+			last := kept[len(kept)-1]
+			if last.Kind == historyHeight && last.Time.Truncate(resolution).Equal(entry.Time.Truncate(resolution)) {
+				kept[len(kept)-1] = entry
+				return
+			}
+		}
+		kept = append(kept, entry)
+	})
+	if err != nil {
+		deskLog.Error("Could not compact history", "err", err)
+		return
+	}
+	if expired != nil {
+		kept = append([]HistoryEntry{*expired}, kept...)
+	}
+
+	// Write the trimmed history alongside and swap it in so a crash can't lose it all.
+	tmpPath := h.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		deskLog.Error("Could not compact history", "err", err)
+		return
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range kept {
+		fmt.Fprintln(writer, entry.encode())
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		deskLog.Error("Could not compact history", "err", err)
+		return
+	}
+	tmp.Close()
+
+	h.file.Close()
+	if err := os.Rename(tmpPath, h.path); err != nil {
+		deskLog.Error("Could not compact history", "err", err)
+	}
+	if err := h.open(); err != nil {
+		deskLog.Error("Could not reopen history", "err", err)
+		h.file = nil
+	}
+}
+
+func (h *HeightHistory) Close() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+}
+
+// Parse a time for a history query, which is either an RFC 3339 timestamp or a
+// duration like 12h meaning that long before now. Empty strings are def.
+func parseHistoryTime(s string, now, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if ago, err := time.ParseDuration(s); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; expected a timestamp like 2006-01-02T15:04:05Z or a duration like 12h", s)
+}
+
+// Format an entry in the unit asked for like formatHeight.
+func formatHistoryEntry(entry HistoryEntry, format func(float32) string) string {
+	line := fmt.Sprintf("%s %s %s", entry.Time.Format(time.RFC3339), entry.Kind, format(entry.Height))
+	if entry.Kind == historySet {
+		line += " target " + format(entry.Target)
+	}
+	return line
+}
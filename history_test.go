@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestHistory(t *testing.T, config HistoryConfig) *HeightHistory {
+	t.Helper()
+	history, err := OpenHeightHistory(config, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(history.Close)
+	return history
+}
+
+// Every entry in history, encoded the way they're written.
+func historyLines(t *testing.T, history *HeightHistory) []string {
+	t.Helper()
+	entries, err := history.Query(time.Time{}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, entry.encode())
+	}
+	return lines
+}
+
+func TestHistoryCompact(t *testing.T) {
+	history := newTestHistory(t, HistoryConfig{File: "history.log", Retention: 1, DownsampleAfter: 1, Resolution: 60})
+	// Times are written in milliseconds.
+	now := time.UnixMilli(time.Now().UnixMilli())
+	// The start of a minute in the part of the history that's thinned out.
+	minute := now.Add(-2 * time.Hour).Truncate(time.Minute)
+	// Half an hour ago, where nothing is thinned out.
+	recent := now.Add(-30 * time.Minute)
+	entry := func(at time.Time, kind string, height float32) HistoryEntry {
+		return HistoryEntry{Time: at, Kind: kind, Height: height}
+	}
+	// The newest entry from before the retention period, which is kept.
+	lastExpired := HistoryEntry{Time: now.AddDate(0, 0, -1).Add(-time.Minute), Kind: historySet, Height: 31, Target: 31.1}
+
+	for _, e := range []HistoryEntry{
+		entry(now.AddDate(0, 0, -3), historyHeight, 30),
+		lastExpired,
+		entry(now.AddDate(0, 0, -1).Add(time.Minute), historyHeight, 32),
+		entry(minute.Add(10*time.Second), historyHeight, 33),
+		entry(minute.Add(20*time.Second), historyHeight, 34),
+		// Moves are never thinned out, and the height changes either side of
+		// them are thinned separately.
+		entry(minute.Add(30*time.Second), historyUp, 35),
+		entry(minute.Add(40*time.Second), historyHeight, 36),
+		entry(minute.Add(50*time.Second), historyHeight, 37),
+		entry(minute.Add(70*time.Second), historyHeight, 38),
+		entry(recent, historyHeight, 40),
+		entry(recent.Add(time.Second), historyHeight, 41),
+	} {
+		history.Record(e)
+	}
+	history.Compact()
+
+	want := []string{
+		lastExpired.encode(),
+		entry(now.AddDate(0, 0, -1).Add(time.Minute), historyHeight, 32).encode(),
+		entry(minute.Add(20*time.Second), historyHeight, 34).encode(),
+		entry(minute.Add(30*time.Second), historyUp, 35).encode(),
+		entry(minute.Add(50*time.Second), historyHeight, 37).encode(),
+		entry(minute.Add(70*time.Second), historyHeight, 38).encode(),
+		entry(recent, historyHeight, 40).encode(),
+		entry(recent.Add(time.Second), historyHeight, 41).encode(),
+	}
+	if got := historyLines(t, history); !reflect.DeepEqual(got, want) {
+		t.Errorf("after compacting:\n%q\nwant:\n%q", got, want)
+	}
+
+	// Compacting again changes nothing, and the history is still recorded to.
+	history.Compact()
+	history.Record(entry(now, historyHeight, 42))
+	want = append(want, entry(now, historyHeight, 42).encode())
+	if got := historyLines(t, history); !reflect.DeepEqual(got, want) {
+		t.Errorf("after compacting again and recording:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+// However long the desk has been left alone, where it was isn't forgotten.
+func TestHistoryCompactKeepsLastHeight(t *testing.T) {
+	history := newTestHistory(t, defaultHistoryConfig)
+	now := time.UnixMilli(time.Now().UnixMilli())
+	left := HistoryEntry{Time: now.AddDate(0, 0, -90), Kind: historyHeight, Height: 29.4}
+	history.Record(HistoryEntry{Time: now.AddDate(0, 0, -91), Kind: historyHeight, Height: 40})
+	history.Record(left)
+	history.Compact()
+
+	if got := historyLines(t, history); !reflect.DeepEqual(got, []string{left.encode()}) {
+		t.Errorf("after compacting: %q; want %q", got, left.encode())
+	}
+	last, found, err := history.Last(now)
+	if err != nil || !found || last.Height != left.Height {
+		t.Errorf("Last = %v, %t, %v; want %v", last, found, err, left)
+	}
+}
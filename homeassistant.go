@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Sender ID of the commands that come from Home Assistant.
+const homeAssistantSender = "home-assistant"
+
+// Payloads Home Assistant uses for switches and for its own status.
+const (
+	haOn     = "ON"
+	haOff    = "OFF"
+	haOnline = "online"
+)
+
+// Characters that can't be used in Home Assistant's object IDs.
+var haInvalidID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// HomeAssistantConfig turns on Home Assistant's MQTT discovery, so that the desk
+// shows up in Home Assistant on its own. It's read from the "HomeAssistant"
+// section of controller.conf and uses the broker in Messaging.MQTT, whichever
+// transport the controllers talk to each other with.
+type HomeAssistantConfig struct {
+	Enabled bool
+	// Prefix Home Assistant looks for discovery payloads under.
+	DiscoveryPrefix string
+	// Name the desk is shown with, if not its ID.
+	Name string
+	// Unit heights are shown and set in: in, cm or mm.
+	Unit Unit
+}
+
+var defaultHomeAssistantConfig = HomeAssistantConfig{
+	DiscoveryPrefix: "homeassistant",
+	Unit:            Inches,
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (h HomeAssistantConfig) Validate() error {
+	var problems []string
+	if h.DiscoveryPrefix == "" {
+		problems = append(problems, "DiscoveryPrefix must be set")
+	}
+	if _, ok := inchesPerUnit[h.Unit]; !ok {
+		problems = append(problems, "Unit must be in, cm or mm")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid HomeAssistant config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Returns an error if id can't be used in Home Assistant's topics for the desk,
+// which share the topic prefix with the MQTT transport's.
+func checkHomeAssistantID(id string) error {
+	if err := checkTopicID(id); err != nil {
+		return err
+	}
+	for _, level := range []string{sitdownChannel, mqttPresenceLevel} {
+		if strings.EqualFold(id, level) {
+			return fmt.Errorf("ID must not be %s with HomeAssistant enabled, since the desk's topics would mix with the ones controllers use", id)
+		}
+	}
+	return nil
+}
+
+// HomeAssistant publishes the desk to Home Assistant as a device with a height
+// sensor, a target height, a preset select, a stop button and switches for the
+// modes. Commands from Home Assistant are turned into Messages and handled the
+// same way as commands from other controllers, except that since they aren't
+// signed, the policy only allows them by rules naming homeAssistantSender.
+type HomeAssistant struct {
+	config     HomeAssistantConfig
+	mqttConfig MQTTConfig
+	controller *Controller
+	handler    func(Message)
+	client     mqtt.Client
+	inbox      *mqttInbox
+	// Home Assistant's object ID for the desk.
+	objectID string
+
+	mux sync.Mutex
+	// Last height published, so that we only publish when it changes.
+	height string
+	// Whether a target has been published, which is the current height until the
+	// desk has been moved.
+	hasTarget bool
+	// Whether each mode is enabled.
+	modes map[string]bool
+}
+
+// NewHomeAssistant connects to the broker in mqttConfig and starts publishing the
+// desk for c, passing commands from Home Assistant to handler.
+func NewHomeAssistant(config HomeAssistantConfig, mqttConfig MQTTConfig, c *Controller, handler func(Message)) (*HomeAssistant, error) {
+	if err := checkHomeAssistantID(c.ID); err != nil {
+		return nil, err
+	}
+	h := &HomeAssistant{
+		config:     config,
+		mqttConfig: mqttConfig,
+		controller: c,
+		handler:    handler,
+		objectID:   "sitdown_" + haInvalidID.ReplaceAllString(c.ID, "_"),
+		modes:      map[string]bool{string(BellToll): false, string(FixHeight): false},
+	}
+	options, err := mqttConfig.clientOptions(c.ID+"-ha", mqttInstance())
+	if err != nil {
+		return nil, err
+	}
+	h.inbox = newMQTTInbox()
+	options.
+		SetWill(h.topic("availability"), mqttOffline, 1, true).
+		SetOnConnectHandler(h.onConnect)
+	if h.client, err = connectMQTT(mqttConfig, options); err != nil {
+		h.inbox.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// State and command topics for the desk, e.g. sitdown/desk3/height.
+func (h *HomeAssistant) topic(parts ...string) string {
+	return h.mqttConfig.TopicPrefix + "/" + h.controller.ID + "/" + strings.Join(parts, "/")
+}
+
+func (h *HomeAssistant) discoveryTopic(component, entity string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", h.config.DiscoveryPrefix, component, h.objectID, entity)
+}
+
+// Subscribe to the commands and publish everything when we connect, and again
+// whenever Home Assistant comes back online since it may have forgotten the desk.
+func (h *HomeAssistant) onConnect(client mqtt.Client) {
+	messagingLog.Info("Connected to MQTT broker for Home Assistant", "broker", h.mqttConfig.Broker)
+	client.Subscribe(h.config.DiscoveryPrefix+"/status", 1, h.inbox.Handler(func(_ mqtt.Client, message mqtt.Message) {
+		if string(message.Payload()) == haOnline {
+			h.publishAll()
+		}
+	}))
+	client.Subscribe(h.topic("+", "set"), 1, h.inbox.Handler(h.handleCommand))
+	h.publishAll()
+}
+
+// Publish the discovery payloads and the current state.
+func (h *HomeAssistant) publishAll() {
+	h.publishDiscovery()
+	h.publish(h.topic("availability"), mqttOnline)
+
+	h.mux.Lock()
+	modes := make(map[string]bool, len(h.modes))
+	for mode, enabled := range h.modes {
+		modes[mode] = enabled
+	}
+	h.mux.Unlock()
+
+	// The height isn't known until the desk has reported it, and then it's published from Run.
+	if height := h.controller.GetHeight(); height > 0 {
+		h.publishHeight(height)
+	}
+	for mode, enabled := range modes {
+		h.publishMode(mode, enabled)
+	}
+}
+
+// Run publishes the desk's state from its events on sub until it is unsubscribed.
+func (h *HomeAssistant) Run(sub *Subscription) {
+	for event := range sub.C() {
+		switch e := event.(type) {
+		case HeightChangedEvent:
+			h.publishHeight(e.Height)
+		case TargetReachedEvent:
+			h.mux.Lock()
+			h.hasTarget = true
+			h.mux.Unlock()
+			h.publish(h.topic("target"), h.format(e.Result.Target))
+		case ModeChangedEvent:
+			h.mux.Lock()
+			h.modes[e.Mode] = e.Enabled
+			h.mux.Unlock()
+			h.publishMode(e.Mode, e.Enabled)
+		case PresetsChangedEvent:
+			h.publishPresets(e.Names)
+		}
+	}
+}
+
+// Publish the height if it has changed, and as the target too if there hasn't
+// been one yet.
+func (h *HomeAssistant) publishHeight(inches float32) {
+	height := h.format(inches)
+	h.mux.Lock()
+	changed, hasTarget := height != h.height, h.hasTarget
+	h.height, h.hasTarget = height, true
+	h.mux.Unlock()
+	if changed {
+		h.publish(h.topic("height"), height)
+	}
+	if !hasTarget {
+		h.publish(h.topic("target"), height)
+	}
+}
+
+// Close marks the desk unavailable and disconnects.
+func (h *HomeAssistant) Close() {
+	h.publish(h.topic("availability"), mqttOffline)
+	h.client.Disconnect(250)
+	h.inbox.Close()
+}
+
+// Format a height in inches in the configured unit, without the unit.
+func (h *HomeAssistant) format(inches float32) string {
+	return strconv.FormatFloat(h.convert(inches), 'f', 1, 64)
+}
+
+// A height in inches in the configured unit, to a tenth.
+func (h *HomeAssistant) convert(inches float32) float64 {
+	return math.Round(float64(HeightFromInches(inches).In(h.config.Unit).Value)*10) / 10
+}
+
+func (h *HomeAssistant) publishMode(mode string, enabled bool) {
+	state := haOff
+	if enabled {
+		state = haOn
+	}
+	h.publish(h.topic(mode), state)
+}
+
+// Publish a retained payload, logging rather than returning errors since there's
+// nothing better to do with them.
+func (h *HomeAssistant) publish(topic string, payload interface{}) {
+	token := h.client.Publish(topic, h.mqttConfig.QoS, true, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		messagingLog.Error("Timed out publishing to Home Assistant", "topic", topic)
+	} else if token.Error() != nil {
+		messagingLog.Error("Could not publish to Home Assistant", "topic", topic, "err", token.Error())
+	}
+}
+
+func (h *HomeAssistant) publishDiscovery() {
+	profile := h.controller.Profile()
+	unit := string(h.config.Unit)
+	step := 0.1
+	if h.config.Unit == Millimetres {
+		step = 1
+	}
+
+	h.publishEntity("sensor", "height", map[string]interface{}{
+		"name":                "Height",
+		"state_topic":         h.topic("height"),
+		"unit_of_measurement": unit,
+		"device_class":        "distance",
+		"state_class":         "measurement",
+		"icon":                "mdi:desk",
+	})
+	h.publishEntity("number", "target", map[string]interface{}{
+		"name":                "Target height",
+		"state_topic":         h.topic("target"),
+		"command_topic":       h.topic("target", "set"),
+		"min":                 h.convert(profile.MinHeight),
+		"max":                 h.convert(profile.MaxHeight),
+		"step":                step,
+		"unit_of_measurement": unit,
+		"device_class":        "distance",
+		"mode":                "box",
+	})
+	h.publishEntity("button", "stop", map[string]interface{}{
+		"name":          "Stop",
+		"command_topic": h.topic("stop", "set"),
+		"icon":          "mdi:stop",
+	})
+	h.publishEntity("switch", string(BellToll), map[string]interface{}{
+		"name":          "Bell toll",
+		"state_topic":   h.topic(string(BellToll)),
+		"command_topic": h.topic(string(BellToll), "set"),
+		"icon":          "mdi:bell",
+	})
+	h.publishEntity("switch", string(FixHeight), map[string]interface{}{
+		"name":          "Fix height",
+		"state_topic":   h.topic(string(FixHeight)),
+		"command_topic": h.topic(string(FixHeight), "set"),
+		"icon":          "mdi:lock",
+	})
+	h.publishPresets(h.controller.PresetNames())
+}
+
+// The preset select can't be empty, so it's removed while there aren't any presets.
+func (h *HomeAssistant) publishPresets(names []string) {
+	if len(names) == 0 {
+		h.publish(h.discoveryTopic("select", "preset"), "")
+		return
+	}
+	h.publishEntity("select", "preset", map[string]interface{}{
+		"name":          "Preset",
+		"command_topic": h.topic("preset", "set"),
+		"options":       names,
+		"optimistic":    true,
+		"icon":          "mdi:bookmark",
+	})
+}
+
+// Publish the discovery payload for an entity of the desk.
+func (h *HomeAssistant) publishEntity(component, entity string, payload map[string]interface{}) {
+	name := h.config.Name
+	if name == "" {
+		name = h.controller.ID
+	}
+	payload["unique_id"] = h.objectID + "_" + entity
+	payload["object_id"] = h.objectID + "_" + entity
+	payload["availability_topic"] = h.topic("availability")
+	payload["device"] = map[string]interface{}{
+		"identifiers":  []string{h.objectID},
+		"name":         name,
+		"manufacturer": "sitdown",
+		"model":        h.controller.Hardware.Profile,
+	}
+	encoded, _ := json.Marshal(payload)
+	h.publish(h.discoveryTopic(component, entity), encoded)
+}
+
+// Turn a command from Home Assistant into a Message for the handler.
+func (h *HomeAssistant) handleCommand(_ mqtt.Client, message mqtt.Message) {
+	entity := strings.TrimSuffix(strings.TrimPrefix(message.Topic(), h.topic("")), "/set")
+	payload := string(message.Payload())
+	command := Message{ID: homeAssistantSender, TargetID: h.controller.ID}
+
+	switch entity {
+	case "target":
+		command.Action, command.Params = Set, []string{payload + string(h.config.Unit)}
+	case "preset":
+		command.Action, command.Params = Set, []string{payload}
+	case "stop":
+		command.Action = Stop
+	case string(BellToll):
+		command.Action, command.Params = BellToll, []string{"disable"}
+		if payload == haOn {
+			command.Params[0] = "enable"
+		}
+	case string(FixHeight):
+		// Hold the desk wherever it is now.
+		command.Action, command.Params = FixHeight, []string{"disable"}
+		if payload == haOn {
+			command.Params[0] = HeightFromInches(h.controller.GetHeight()).String()
+		}
+	default:
+		messagingLog.Warn("Ignoring command from Home Assistant", "topic", message.Topic())
+		return
+	}
+	messagingLog.Info("Received command", "command", command.Action, "sender", command.ID, "params", command.Params)
+	h.handler(command)
+}
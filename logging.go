@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Parts of sitdown that log with their own verbosity.
+const (
+	subsystemDesk      = "desk"
+	subsystemMessaging = "messaging"
+	subsystemHTTP      = "http"
+	subsystemModes     = "modes"
+	subsystemPolicy    = "policy"
+)
+
+var subsystems = []string{subsystemDesk, subsystemMessaging, subsystemHTTP, subsystemModes, subsystemPolicy}
+
+// Where log records go.
+const (
+	logOutputStderr  = "stderr"
+	logOutputFile    = "file"
+	logOutputJournal = "journal"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// LoggingConfig controls how much sitdown logs and where to. It's read from the
+// "Logging" section of controller.conf.
+type LoggingConfig struct {
+	// One of stderr, file or journal (the systemd journal).
+	Output string
+	// Path of the log file for the file output. Relative paths are relative to
+	// controller.conf.
+	File string
+	// Megabytes the log file may grow to before it's rotated, and how many of the
+	// old files to keep.
+	MaxSize  int
+	MaxFiles int
+	// Least severe level that is logged (debug, info, warn or error), for every
+	// subsystem not in Levels.
+	Level  string
+	Levels map[string]string
+}
+
+var defaultLoggingConfig = LoggingConfig{
+	Output:   logOutputStderr,
+	File:     "sitdown.log",
+	MaxSize:  10,
+	MaxFiles: 3,
+	Level:    "info",
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (l LoggingConfig) Validate() error {
+	var problems []string
+	switch l.Output {
+	case logOutputStderr, logOutputJournal:
+	case logOutputFile:
+		if l.File == "" {
+			problems = append(problems, "File must be set for the file output")
+		}
+		if l.MaxSize <= 0 {
+			problems = append(problems, "MaxSize must be greater than 0")
+		}
+		if l.MaxFiles < 0 {
+			problems = append(problems, "MaxFiles must not be negative")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown Output %q; expected stderr, file or journal", l.Output))
+	}
+	if _, err := parseLogLevel(l.Level); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for subsystem, level := range l.Levels {
+		if !validSubsystem(subsystem) {
+			problems = append(problems, fmt.Sprintf("unknown subsystem %q in Levels", subsystem))
+		} else if _, err := parseLogLevel(level); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", subsystem, err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid Logging config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validSubsystem(name string) bool {
+	for _, subsystem := range subsystems {
+		if subsystem == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q; expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// The handler that every subsystem's records end up at. It's swapped out when
+// the logging config is applied, so the subsystem loggers can be created before
+// the config has been read.
+var (
+	logSink    atomic.Pointer[sinkHolder]
+	logLevels  = make(map[string]*slog.LevelVar)
+	sinkCloser io.Closer
+	sinkMux    sync.Mutex
+)
+
+type sinkHolder struct {
+	handler slog.Handler
+}
+
+// Loggers for each subsystem.
+var (
+	deskLog      = newSubsystemLogger(subsystemDesk)
+	messagingLog = newSubsystemLogger(subsystemMessaging)
+	httpLog      = newSubsystemLogger(subsystemHTTP)
+	modesLog     = newSubsystemLogger(subsystemModes)
+	policyLog    = newSubsystemLogger(subsystemPolicy)
+)
+
+func init() {
+	logSink.Store(&sinkHolder{textHandler(os.Stderr)})
+}
+
+func newSubsystemLogger(name string) *slog.Logger {
+	level := new(slog.LevelVar)
+	logLevels[name] = level
+	return slog.New(&subsystemHandler{level: level}).With("subsystem", name)
+}
+
+func textHandler(w io.Writer) slog.Handler {
+	// Levels are checked by subsystemHandler, so let everything through here.
+	return slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})
+}
+
+// ConfigureLogging applies config, sending records to its output with deskID
+// attached to each of them. Relative paths are taken to be relative to dir.
+func ConfigureLogging(config LoggingConfig, dir string, deskID string) error {
+	var handler slog.Handler
+	var closer io.Closer
+	switch config.Output {
+	case logOutputFile:
+		path := config.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		file, err := openRotatingFile(path, int64(config.MaxSize)*1024*1024, config.MaxFiles)
+		if err != nil {
+			return fmt.Errorf("could not open log file: %s", err.Error())
+		}
+		handler, closer = textHandler(file), file
+	case logOutputJournal:
+		journal, err := openJournal()
+		if err != nil {
+			return fmt.Errorf("could not connect to the systemd journal: %s", err.Error())
+		}
+		handler, closer = journal, journal
+	default:
+		handler = textHandler(os.Stderr)
+	}
+	if deskID != "" {
+		handler = handler.WithAttrs([]slog.Attr{slog.String("desk", deskID)})
+	}
+
+	sinkMux.Lock()
+	logSink.Store(&sinkHolder{handler})
+	if sinkCloser != nil {
+		sinkCloser.Close()
+	}
+	sinkCloser = closer
+	sinkMux.Unlock()
+
+	defaultLevel, _ := parseLogLevel(config.Level)
+	for _, subsystem := range subsystems {
+		level := defaultLevel
+		if name, ok := config.Levels[subsystem]; ok {
+			level, _ = parseLogLevel(name)
+		}
+		logLevels[subsystem].Set(level)
+	}
+	return nil
+}
+
+// SetLogLevel changes how much subsystem logs, or every subsystem if it's empty.
+func SetLogLevel(subsystem, level string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if subsystem == "" {
+		for _, levelVar := range logLevels {
+			levelVar.Set(parsed)
+		}
+		return nil
+	}
+	levelVar, ok := logLevels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown subsystem %q; expected one of %s", subsystem, strings.Join(subsystems, ", "))
+	}
+	levelVar.Set(parsed)
+	return nil
+}
+
+// LogLevels returns each subsystem's level, as "subsystem level" in alphabetical order.
+func LogLevels() []string {
+	var levels []string
+	for subsystem, level := range logLevels {
+		levels = append(levels, subsystem+" "+strings.ToLower(level.Level().String()))
+	}
+	sort.Strings(levels)
+	return levels
+}
+
+// subsystemHandler filters records by its subsystem's level and passes the rest
+// to whatever the current sink is.
+type subsystemHandler struct {
+	level *slog.LevelVar
+	// Attributes and groups added with With and WithGroup, in order.
+	parts []handlerPart
+}
+
+type handlerPart struct {
+	attrs []slog.Attr
+	group string
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := logSink.Load().handler
+	for _, part := range h.parts {
+		if part.group != "" {
+			handler = handler.WithGroup(part.group)
+		} else {
+			handler = handler.WithAttrs(part.attrs)
+		}
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(handlerPart{attrs: attrs})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(handlerPart{group: name})
+}
+
+func (h *subsystemHandler) with(part handlerPart) *subsystemHandler {
+	parts := make([]handlerPart, len(h.parts), len(h.parts)+1)
+	copy(parts, h.parts)
+	return &subsystemHandler{level: h.level, parts: append(parts, part)}
+}
+
+// rotatingFile is a log file that is moved aside to path.1, path.2 and so on
+// when it grows past maxSize, keeping maxFiles of the old ones.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mux  sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Must be called with mux held.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	if r.maxFiles == 0 {
+		os.Remove(r.path)
+	} else {
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// journalHandler sends records to the systemd journal using its native protocol,
+// so that the level and fields can be filtered on with journalctl.
+type journalHandler struct {
+	conn  *net.UnixConn
+	attrs []slog.Attr
+	group string
+}
+
+func openJournal() (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn}, nil
+}
+
+func (h *journalHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *journalHandler) Handle(_ context.Context, record slog.Record) error {
+	var entry strings.Builder
+	writeJournalField(&entry, "PRIORITY", journalPriority(record.Level))
+	writeJournalField(&entry, "SYSLOG_IDENTIFIER", "sitdown")
+	writeJournalField(&entry, "MESSAGE", record.Message)
+	for _, attr := range h.attrs {
+		writeJournalAttr(&entry, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		writeJournalAttr(&entry, h.group, attr)
+		return true
+	})
+	_, err := h.conn.Write([]byte(entry.String()))
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		prefixed[i] = slog.Attr{Key: joinJournalKey(h.group, attr.Key), Value: attr.Value}
+	}
+	return &journalHandler{conn: h.conn, attrs: append(append([]slog.Attr{}, h.attrs...), prefixed...), group: h.group}
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{conn: h.conn, attrs: h.attrs, group: joinJournalKey(h.group, name)}
+}
+
+func (h *journalHandler) Close() error {
+	return h.conn.Close()
+}
+
+func writeJournalAttr(entry *strings.Builder, group string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	key := joinJournalKey(group, attr.Key)
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, member := range attr.Value.Group() {
+			writeJournalAttr(entry, key, member)
+		}
+		return
+	}
+	writeJournalField(entry, journalFieldName(key), attr.Value.String())
+}
+
+func joinJournalKey(group, key string) string {
+	if group == "" {
+		return key
+	}
+	return group + "_" + key
+}
+
+// Journal field names are upper case letters, digits and underscores and can't
+// start with an underscore, which is reserved for fields set by the journal.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+// Write a field in the journal's native format. Values with newlines in them
+// have to be written with their length instead of as KEY=VALUE lines.
+func writeJournalField(entry *strings.Builder, name, value string) {
+	if name == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(entry, "%s=%s\n", name, value)
+		return
+	}
+	entry.WriteString(name + "\n")
+	size := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		entry.WriteByte(byte(size >> (8 * i)))
+	}
+	entry.WriteString(value + "\n")
+}
+
+func journalPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	default:
+		return "7"
+	}
+}
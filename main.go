@@ -1,46 +1,91 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 var (
-	// Global logger that should be used for any output.
-	logger = log.New(os.Stdin, "", log.Ltime)
 	// Controller instance for the currently running sitdown process.
 	controller *Controller
-	// Messenger instance responsible for PubNub communication.
+	// Messenger instance responsible for communicating with other controllers.
 	messenger *Messenger
+	// Counts exported on /metrics.
+	metrics = NewMetrics()
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "emulate":
+			RunEmulator(os.Args[2:])
+			return
+		case "calibrate":
+			RunCalibration(os.Args[2:])
+			return
+		case "keygen":
+			RunKeygen()
+			return
+		}
+	}
+
 	commandMode := flag.Bool("c", false, "Start the server in command mode")
 	resetMode := flag.Bool("r", false, "Reset the pins to HIGH in case they're stuck")
-	port := flag.String("p", "8080", "Listen on the specified port")
+	port := flag.String("p", "", "Listen on the specified port instead of the configured Port")
+	simulate := flag.Bool("s", false, "Use a simulated desk instead of the GPIO pins and serial port")
+	serialPort := flag.String("d", "", "Read heights from this serial device instead of the configured SerialPort")
+	buttonFile := flag.String("b", "", "Write button presses to this file instead of the GPIO pins")
+	captureFile := flag.String("capture", "", "Record the raw serial stream to this file")
+	replayFile := flag.String("replay", "", "Read heights from a recording made with -capture instead of the serial port")
+	replaySpeed := flag.Float64("replay-speed", 1, "Speed multiplier for -replay (0 to replay as fast as possible)")
+	configPath, overrides := addConfigFlags(flag.CommandLine)
 	flag.Parse()
+	if *port != "" {
+		overrides.Set("Port=" + *port)
+	}
+	if *serialPort != "" {
+		overrides.Set("Hardware.SerialPort=" + *serialPort)
+	}
 
 	controller = new(Controller)
-	controller.InitFromConfig()
+	controller.InitFromConfig(*configPath, *overrides)
+
+	controller.desk = newDesk(controller.Hardware, controller.Profile(), DeskOptions{
+		Simulate:    *simulate,
+		ButtonFile:  *buttonFile,
+		CaptureFile: *captureFile,
+		ReplayFile:  *replayFile,
+		ReplaySpeed: *replaySpeed,
+	})
 
 	// Only set the pins back to HIGH and then exit.
 	if *resetMode {
-		logger.Println("Clearing pins and exiting")
-		controller.desk.Setup(logger)
+		deskLog.Info("Clearing pins and exiting")
+		controller.desk.Setup()
 		controller.Cleanup()
 		return
 	}
 
 	registerSignalHandlers()
 
+	// The command client has to be connected under its own ID for desks to reply to it.
+	if *commandMode {
+		controller.ID = CommandClientId
+	}
 	messenger = new(Messenger)
-	messenger.Initialize()
+	if err := messenger.Initialize(); err != nil {
+		fmt.Println("Could not start messaging: " + err.Error())
+		os.Exit(1)
+	}
 	defer messenger.Cleanup()
 
 	if *commandMode {
@@ -48,10 +93,53 @@ func main() {
 	} else {
 		controller.EnterDeskControlMode()
 		defer controller.Cleanup()
-		StartHTTPEndpoint(*port)
+		registerReloadHandler()
+		StartHTTPEndpoint(strconv.Itoa(controller.Port))
 	}
 }
 
+// DeskOptions are the command line options for swapping out the desk's hardware.
+type DeskOptions struct {
+	Simulate    bool
+	ButtonFile  string
+	CaptureFile string
+	ReplayFile  string
+	ReplaySpeed float64
+}
+
+// Create the Desk for the configured hardware, or whatever replaces it in options.
+func newDesk(hardware HardwareConfig, profile DeskProfile, options DeskOptions) *Desk {
+	var actuator Actuator
+	var sensor HeightSensor
+	if options.Simulate {
+		deskLog.Info("Using simulated desk")
+		sim := NewSimulatedDesk(profile)
+		actuator, sensor = sim, sim
+	} else {
+		switch {
+		case options.ButtonFile != "":
+			actuator = NewButtonFileActuator(options.ButtonFile)
+		case options.ReplayFile != "":
+			// Replays are for looking at recordings away from the desk, so there are no pins to drive.
+			actuator = NopActuator{}
+		default:
+			actuator = NewPiActuator(hardware.UpPin, hardware.DownPin)
+		}
+
+		if options.ReplayFile != "" {
+			sensor = NewReplayHeightSensor(options.ReplayFile, options.ReplaySpeed, profile)
+		} else {
+			serialSensor := NewSerialHeightSensor(hardware.SerialOptions(), profile)
+			serialSensor.CaptureFile = options.CaptureFile
+			sensor = serialSensor
+		}
+	}
+
+	desk := NewDesk(hardware.MotorGuard(actuator), sensor, profile)
+	desk.SetObstructionDetection(time.Duration(hardware.StallWindow)*time.Millisecond, hardware.ObstructionBackoff)
+	return desk
+}
+
 // Attempt to cover all of our bases for cleanup.
 func registerSignalHandlers() {
 	killChan := make(chan os.Signal)
@@ -59,19 +147,42 @@ func registerSignalHandlers() {
 
 	go func() {
 		<-killChan
-		logger.Println("Cleaning up from signal handler")
+		deskLog.Info("Cleaning up from signal handler")
 		controller.Cleanup()
 		messenger.Cleanup()
 		os.Exit(0)
 	}()
 }
 
+// Reload the config on SIGHUP.
+func registerReloadHandler() {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			if err := controller.Reload(); err != nil {
+				deskLog.Error("Could not reload config", "err", err)
+			}
+		}
+	}()
+}
+
 // Start and block on an HTTP client listening for commands from the network.
 func StartHTTPEndpoint(port string) {
 	http.HandleFunc("/move", HandleMove)
 	http.HandleFunc("/set", HandleSet)
+	http.HandleFunc("/stop", HandleStop)
 	http.HandleFunc("/height", HandleHeight)
-	logger.Println("Starting HTTP server")
+	http.HandleFunc("/metrics", HandleMetrics)
+	http.HandleFunc("/loglevel", HandleLogLevel)
+	http.HandleFunc("/history", HandleHistory)
+	http.HandleFunc("/analytics", HandleAnalytics)
+	http.HandleFunc("/analytics/summary", HandleAnalyticsSummary)
+	http.HandleFunc("/presets", HandlePresets)
+	http.HandleFunc("/preset/save", HandleSavePreset)
+	http.HandleFunc("/preset/delete", HandleDeletePreset)
+	httpLog.Info("Starting HTTP server", "port", port)
 
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		panic(err)
@@ -82,37 +193,263 @@ func StartHTTPEndpoint(port string) {
 func HandleMove(responseWriter http.ResponseWriter, request *http.Request) {
 	vals, err := url.ParseQuery(request.URL.RawQuery)
 	if err != nil {
-		logger.Println(err)
+		httpLog.Warn("Invalid query", "path", request.URL.Path, "err", err)
 		return
 	}
 	direction := vals["direction"][0]
 	if direction != "down" && direction != "up" {
-		logger.Printf("Invalid direction: %s\n", direction)
+		httpLog.Warn("Invalid direction", "direction", direction)
 		return
 	}
 	duration, err := strconv.Atoi(vals["time"][0])
 	if err != nil || duration < 0 || duration > 10000 {
-		logger.Printf("Invalid time: %d\n", duration)
+		httpLog.Warn("Invalid time", "time", vals["time"][0])
+		return
+	}
+
+	if _, err := ParseUnit(vals.Get("unit")); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	height, profile := controller.GetHeight(), controller.Profile()
+	if (direction == "up" && height >= profile.MaxHeight) ||
+		(direction == "down" && height <= profile.MinHeight) {
+		httpLog.Info("Desk is already at its limit; not moving", "height", height, "direction", direction)
+		fmt.Fprintf(responseWriter, "Already at %s", formatHeight(height, vals))
 		return
 	}
 
-	logger.Printf("Received move command: %s %d\n", direction, duration)
-	controller.Move(direction, duration)
-	fmt.Fprintf(responseWriter, "Moved to %.1f", controller.GetHeight())
+	if !authorizeHTTP(responseWriter, Move, direction, strconv.Itoa(duration)) {
+		return
+	}
+	httpLog.Info("Received move command", "direction", direction, "duration", duration)
+	metrics.MoveRequested(moveSourceHTTP)
+	if err := controller.Move(request.Context(), direction, duration); err != nil {
+		http.Error(responseWriter, err.Error(), httpStatusForError(err))
+		return
+	}
+	fmt.Fprintf(responseWriter, "Moved to %s", formatHeight(controller.GetHeight(), vals))
 }
 
 // Handler method for HTTP requests sent to /set.
 func HandleSet(responseWriter http.ResponseWriter, request *http.Request) {
 	vals, err := url.ParseQuery(request.URL.RawQuery)
 	if err != nil {
-		logger.Println(err)
+		httpLog.Warn("Invalid query", "path", request.URL.Path, "err", err)
+		return
+	}
+	if _, err := ParseUnit(vals.Get("unit")); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	height, err := controller.ResolveHeight(vals.Get("height"))
+	if err != nil {
+		httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeHTTP(responseWriter, Set, vals.Get("height")) {
 		return
 	}
-	controller.SetHeight(vals["height"][0])
-	fmt.Fprintf(responseWriter, "Changed to %.1f", controller.GetHeight())
+	metrics.MoveRequested(moveSourceHTTP)
+	if err := controller.SetHeight(request.Context(), height); err != nil {
+		httpLog.Warn("Could not set height", "err", err)
+		http.Error(responseWriter, err.Error(), httpStatusForError(err))
+		return
+	}
+	fmt.Fprintf(responseWriter, "Changed to %s", formatHeight(controller.GetHeight(), vals))
+}
+
+// Handler method for HTTP requests sent to /stop.
+func HandleStop(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if _, err := ParseUnit(vals.Get("unit")); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	controller.Stop()
+	fmt.Fprintf(responseWriter, "Stopped at %s", formatHeight(controller.GetHeight(), vals))
 }
 
 // Handler method for HTTP requests sent to /height.
 func HandleHeight(responseWriter http.ResponseWriter, request *http.Request) {
-	fmt.Fprintf(responseWriter, "%.1f", controller.GetHeight())
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if _, err := ParseUnit(vals.Get("unit")); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(responseWriter, formatHeight(controller.GetHeight(), vals))
+}
+
+// Handler method for HTTP requests sent to /metrics.
+func HandleMetrics(responseWriter http.ResponseWriter, request *http.Request) {
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(responseWriter, controller.desk)
+}
+
+// Handler method for HTTP requests sent to /loglevel. Sets the level of subsystem,
+// or every subsystem if it's not given, to level and lists the levels.
+func HandleLogLevel(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if level := vals.Get("level"); level != "" {
+		if !authorizeHTTP(responseWriter, LogLevel, level, vals.Get("subsystem")) {
+			return
+		}
+		if err := SetLogLevel(vals.Get("subsystem"), level); err != nil {
+			httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpLog.Info("Changed log level", "subsystem", vals.Get("subsystem"), "level", level)
+	}
+	for _, level := range LogLevels() {
+		fmt.Fprintln(responseWriter, level)
+	}
+}
+
+// Handler method for HTTP requests sent to /history. Lists the entries between
+// from and to one per line, oldest first.
+func HandleHistory(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if _, err := ParseUnit(vals.Get("unit")); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeHTTP(responseWriter, History, vals.Get("from"), vals.Get("to")) {
+		return
+	}
+	entries, err := controller.QueryHistory(vals.Get("from"), vals.Get("to"))
+	if err != nil {
+		httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, entry := range entries {
+		fmt.Fprintln(responseWriter, formatHistoryEntry(entry, func(inches float32) string {
+			return formatHeight(inches, vals)
+		}))
+	}
+}
+
+// Handler method for HTTP requests sent to /analytics. Responds with the DailyReport
+// for date, or today, as JSON.
+func HandleAnalytics(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if !authorizeHTTP(responseWriter, Summary, vals.Get("date")) {
+		return
+	}
+	report, err := controller.DailyReport(vals.Get("date"))
+	if err != nil {
+		httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(report)
+}
+
+// Handler method for HTTP requests sent to /analytics/summary. Responds with the
+// DailyReport for date, or today, as plain text.
+func HandleAnalyticsSummary(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if !authorizeHTTP(responseWriter, Summary, vals.Get("date")) {
+		return
+	}
+	report, err := controller.DailyReport(vals.Get("date"))
+	if err != nil {
+		httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, line := range report.Summary() {
+		fmt.Fprintln(responseWriter, line)
+	}
+}
+
+// Handler method for HTTP requests sent to /presets. Lists the presets one per line.
+func HandlePresets(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	if _, err := ParseUnit(vals.Get("unit")); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeHTTP(responseWriter, Preset, "list") {
+		return
+	}
+	for _, name := range controller.PresetNames() {
+		height, _ := controller.Preset(name)
+		fmt.Fprintf(responseWriter, "%s %s\n", name, formatHeight(height.Inches(), vals))
+	}
+}
+
+// Handler method for HTTP requests sent to /preset/save.
+func HandleSavePreset(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	name := vals.Get("name")
+	if !authorizeHTTP(responseWriter, Preset, "save", name, vals.Get("height")) {
+		return
+	}
+	height, err := ParseHeight(vals.Get("height"))
+	if err == nil {
+		err = controller.SavePreset(name, height)
+	}
+	if err != nil {
+		httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	httpLog.Info("Saved preset", "name", name, "height", height)
+	fmt.Fprintf(responseWriter, "Saved %s as %s", name, height)
+}
+
+// Handler method for HTTP requests sent to /preset/delete.
+func HandleDeletePreset(responseWriter http.ResponseWriter, request *http.Request) {
+	vals, _ := url.ParseQuery(request.URL.RawQuery)
+	name := vals.Get("name")
+	if !authorizeHTTP(responseWriter, Preset, "delete", name) {
+		return
+	}
+	if err := controller.DeletePreset(name); err != nil {
+		httpLog.Warn("Bad request", "path", request.URL.Path, "err", err)
+		http.Error(responseWriter, err.Error(), http.StatusNotFound)
+		return
+	}
+	httpLog.Info("Deleted preset", "name", name)
+	fmt.Fprintf(responseWriter, "Deleted %s", name)
+}
+
+// Check that the policy allows an HTTP request to send action with params, and
+// respond with a 403 if it doesn't.
+func authorizeHTTP(responseWriter http.ResponseWriter, action Command, params ...string) bool {
+	if err := controller.Authorize(senderHTTP, action, params); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Pick the status code to respond with for an error from moving the desk.
+func httpStatusForError(err error) int {
+	if errors.Is(err, errMoveStopped) {
+		return http.StatusConflict
+	}
+	switch err.(type) {
+	case *SafetyError:
+		return http.StatusTooManyRequests
+	case *ObstructionError:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Format a height from the desk in the unit asked for with the unit query parameter.
+// Without one, heights are plain numbers in inches like they've always been.
+func formatHeight(inches float32, vals url.Values) string {
+	if vals.Get("unit") == "" {
+		return fmt.Sprintf("%.1f", inches)
+	}
+	unit, _ := ParseUnit(vals.Get("unit"))
+	return HeightFromInches(inches).In(unit).String()
 }
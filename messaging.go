@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"github.com/pubnub/go/messaging"
+	"fmt"
 	"net"
 	"strings"
 	"time"
@@ -16,15 +16,38 @@ const (
 	Move Command = "move"
 	// Set the desk to a particular height. Syntax: set TARGET HEIGHT
 	Set Command = "set"
+	// Stop the desk, cancelling the move in progress and any waiting to start. Syntax: stop TARGET
+	Stop Command = "stop"
 	// BellToll will cause the Pi to adjust up/down on the hour. Syntax: belltoll TARGET (enable|disable).
 	BellToll Command = "belltoll"
 	// FixHeight will cause a desk to reset to the specified height when changed (after a small delay).
 	// Syntax: fixheight TARGET (enable|disable)
 	FixHeight Command = "fixheight"
+	// Preset manages the named heights that set and fixheight accept in place of a number.
+	// Syntax: preset TARGET (save NAME HEIGHT|delete NAME|list)
+	Preset Command = "preset"
+	// History asks a desk for what it has been doing, which it reports back to the sender.
+	// FROM and TO are timestamps or durations ago, defaulting to 24h and now.
+	// Syntax: history TARGET [FROM [TO]]
+	History Command = "history"
+	// Summary asks a desk how long it was sat and stood at on DATE (YYYY-MM-DD, default
+	// today), which it reports back to the sender. Syntax: summary TARGET [DATE]
+	Summary Command = "summary"
+	// LogLevel changes how much a desk logs, for every subsystem or just the one given.
+	// Syntax: loglevel TARGET (debug|info|warn|error) [SUBSYSTEM]
+	LogLevel Command = "loglevel"
 	// Announce is an internal command used for discovery purposes.
 	Announce Command = "announce"
+	// Report is an internal command carrying a desk's answer to a command back to the sender.
+	Report Command = "report"
+	// Reply is an internal command carrying a desk's CommandResult for a command
+	// back to the sender, when the sender gave the command a RequestID.
+	Reply Command = "reply"
 )
 
+// Most history entries sent back for a history command, to keep messages small.
+const historyReportLimit = 100
+
 const (
 	CommandClientId = "command-client"
 	sitdownChannel  = "controller"
@@ -41,38 +64,65 @@ type Message struct {
 	IPAddr string
 	// ID of the intended recipient.
 	TargetID string
+	// ID the sender gave a command to match up the replies to it, which carry the
+	// same ID. Commands without one don't get replies.
+	RequestID string `json:",omitempty"`
+	// How the command being replied to went, for replies.
+	Result *CommandResult `json:",omitempty"`
+	// When the message was sent, in Unix milliseconds, and a random string that's
+	// different for every message, so that old messages can't be sent again.
+	Timestamp int64
+	Nonce     string
+	// Signature of everything above, if the sender has a key.
+	Signature string `json:",omitempty"`
 }
 
+// Messenger sends and receives Messages between controllers over whichever
+// Transport is configured.
 type Messenger struct {
-	pubnub *messaging.Pubnub
+	// ID of the controller we send and receive messages as.
+	id        string
+	transport Transport
+	auth      *MessageAuth
+	// Requests we're waiting for replies to.
+	replies *replyTracker
+}
+
+func (m *Messenger) Initialize() error {
+	auth, err := NewMessageAuth(controller.Messaging.Signing)
+	if err != nil {
+		return err
+	}
+	transport, err := newTransport(controller.Config, controller.ID)
+	if err != nil {
+		return err
+	}
+	*m = *newMessenger(controller.ID, transport, auth)
+	messagingLog.Info("Using transport", "transport", controller.Messaging.Transport)
+	return nil
 }
 
-func (m *Messenger) Initialize() {
-	m.pubnub = messaging.NewPubnub(controller.PubKey, controller.SubKey, "", "", true, "", nil)
-	m.pubnub.SetUUID(controller.ID)
+func newMessenger(id string, transport Transport, auth *MessageAuth) *Messenger {
+	return &Messenger{id: id, transport: transport, auth: auth, replies: newReplyTracker()}
 }
 
 func (m *Messenger) Cleanup() {
-	successChan := make(chan []byte)
-	errorChan := make(chan []byte)
-
-	go m.pubnub.Unsubscribe(sitdownChannel, successChan, errorChan)
-	select {
-	case <-successChan:
-		logger.Println("Unsubscribed from channel")
-	case err := <-errorChan:
-		logger.Println("Failed to unsubscribe from channel: " + string(err))
-	case <-messaging.Timeout():
-		logger.Println("Timeout while unsubcribing from channel")
+	if err := m.transport.Close(); err != nil {
+		messagingLog.Error("Could not close transport", "err", err)
 	}
 }
 
+// Present lists the IDs of the controllers that are connected right now.
+func (m Messenger) Present() ([]string, error) {
+	return m.transport.Presence(sitdownChannel)
+}
+
 // Kick off a goroutine that will write a message to the channel with some basic
 // info about the device for discovery by other controllers and the command client.
 func (m Messenger) StartAnnouncing() {
 	go func() {
 		ipAddress, err := getIPAddress()
-		logger.Println("Announcing IP address: " + ipAddress)
+		messagingLog.Info("Announcing IP address", "ip", ipAddress)
 		if ipAddress != "" && err != nil {
 			m.Publish(Announce, ipAddress, "all", nil)
 		}
@@ -83,7 +133,7 @@ func (m Messenger) StartAnnouncing() {
 			case <-timer.C:
 				ipAddress, err := getIPAddress()
 				if err != nil {
-					logger.Printf("Could not determine IP: %s", err.Error())
+					messagingLog.Error("Could not determine IP address", "err", err)
 				} else if ipAddress != "" {
 					m.Publish(Announce, ipAddress, "all", nil)
 				}
@@ -95,7 +145,7 @@ func (m Messenger) StartAnnouncing() {
 func getIPAddress() (string, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		logger.Println("ERROR: Could not announce IP address " + err.Error())
+		messagingLog.Error("Could not list network interfaces", "err", err)
 		return "", err
 	}
 
@@ -105,7 +155,7 @@ func getIPAddress() (string, error) {
 		if iface.Name == "wlan0" {
 			addrs, err := iface.Addrs()
 			if err != nil {
-				logger.Printf("Could not retrieve Addrs " + err.Error())
+				messagingLog.Error("Could not retrieve interface addresses", "interface", iface.Name, "err", err)
 				continue
 			}
 
@@ -118,7 +168,7 @@ func getIPAddress() (string, error) {
 						break iploop
 					}
 				default:
-					logger.Printf("Found Addr of type %#v\n", t)
+					messagingLog.Debug("Skipping address", "type", fmt.Sprintf("%T", t))
 				}
 			}
 		}
@@ -126,72 +176,106 @@ func getIPAddress() (string, error) {
 	return ipAddress, err
 }
 
-// Subscribe to the PubNub channel and decode messages as they come in.
+// Subscribe to the channel and decode messages as they come in.
 // Valid messages will be passed to handlerFn with the full Message struct.
 func (m Messenger) StartSubscriber(handlerFn func(Message)) {
-	successChan := make(chan []byte)
-	errorChan := make(chan []byte)
-
-	logger.Println("Subscribing to " + sitdownChannel)
-	go m.pubnub.Subscribe(sitdownChannel, "", successChan, false, errorChan)
-
-	go func() {
-		for {
-			select {
-			case response := <-successChan:
-				var msg []interface{}
-				if err := json.Unmarshal(response, &msg); err != nil {
-					logger.Println("Could not process command: " + err.Error())
-				}
-
-				switch msg[0].(type) {
-				case []interface{}:
-					encoded := msg[0].([]interface{})[0].(string)
-					var message Message
-					json.Unmarshal([]byte(encoded), &message)
-
-					targetID := strings.ToLower(message.TargetID)
-					controllerID := strings.ToLower(controller.ID)
-
-					// Throw out messages sent from the same device or that
-					// are directed to another device.
-					if message.ID != controller.ID &&
-						(targetID == "all" || targetID == controllerID) {
-						logger.Printf("Received command: %#v\n", message)
+	messagingLog.Info("Subscribing to channel", "channel", sitdownChannel)
+	err := m.transport.Subscribe(sitdownChannel, func(payload []byte) {
+		var message Message
+		if err := json.Unmarshal(payload, &message); err != nil {
+			messagingLog.Error("Could not process command", "err", err)
+			return
+		}
 
-						handlerFn(message)
-					}
-				default:
-					logger.Printf("Ignoring message: %v\n", msg)
+		targetID := strings.ToLower(message.TargetID)
+		controllerID := strings.ToLower(m.id)
 
-				}
-			case err := <-errorChan:
-				logger.Println("Received message on error channel: " + string(err))
+		// Throw out messages sent from the same device or that
+		// are directed to another device.
+		if message.ID == m.id ||
+			(targetID != broadcastTarget && targetID != controllerID) {
+			return
+		}
+		metrics.Message(messageReceived)
+		if err := m.auth.Verify(message); err != nil {
+			metrics.Message(messageRejected)
+			messagingLog.Warn("Rejected command", "command", message.Action, "sender", message.ID, "err", err)
+			return
+		}
+		if message.Action == Reply {
+			if !m.replies.deliver(message) {
+				messagingLog.Debug("Ignoring reply to unknown request", "sender", message.ID, "request", message.RequestID)
 			}
+			return
 		}
-	}()
+		messagingLog.Info("Received command", "command", message.Action, "sender", message.ID, "params", message.Params)
+
+		handlerFn(message)
+	}, func(err error) {
+		metrics.Message(messageFailed)
+		messagingLog.Error("Could not receive message", "err", err)
+	})
+	if err != nil {
+		messagingLog.Error("Could not subscribe to channel", "channel", sitdownChannel, "err", err)
+	}
 }
 
-// Write a message to our channel on PubNub.
+// Write a message to our channel.
 func (m Messenger) Publish(command Command, sourceIP string, targetID string, params []string) {
-	successChan := make(chan []byte)
-	errorChan := make(chan []byte)
-
-	cmd := &Message{
+	m.send(&Message{
 		Action:   command,
 		Params:   params,
-		ID:       controller.ID,
+		ID:       m.id,
 		IPAddr:   sourceIP,
 		TargetID: targetID,
+	})
+}
+
+// Request publishes a command that the targets reply to, returning the request's
+// ID and the channel the replies are delivered on. Callers should forget the
+// request once they're done waiting for replies.
+func (m Messenger) Request(command Command, targetID string, params []string) (string, <-chan Message) {
+	requestID := newRequestID()
+	replies := m.replies.expect(requestID)
+	m.send(&Message{
+		Action:    command,
+		Params:    params,
+		ID:        m.id,
+		TargetID:  targetID,
+		RequestID: requestID,
+	})
+	return requestID, replies
+}
+
+// Reply tells the sender of message how its command went, if it asked to be told.
+func (m Messenger) Reply(message Message, result CommandResult) {
+	if message.RequestID == "" {
+		return
 	}
+	m.send(&Message{
+		Action:    Reply,
+		ID:        m.id,
+		TargetID:  message.ID,
+		RequestID: message.RequestID,
+		Result:    &result,
+	})
+}
 
-	jsonCmd, _ := json.Marshal(cmd)
-	m.pubnub.Publish(sitdownChannel, string(jsonCmd), successChan, errorChan)
+func (m Messenger) send(cmd *Message) {
+	m.auth.Sign(cmd)
 
-	select {
-	case <-successChan:
-		logger.Printf("Publishing command: %+v\n", cmd)
-	case err := <-errorChan:
-		logger.Println("Error publishing command " + string(err))
+	jsonCmd, _ := json.Marshal(cmd)
+	var err error
+	if cmd.Action == Announce {
+		err = m.transport.Announce(sitdownChannel, jsonCmd)
+	} else {
+		err = m.transport.Publish(sitdownChannel, cmd.TargetID, jsonCmd)
+	}
+	if err != nil {
+		metrics.Message(messageFailed)
+		messagingLog.Error("Could not publish command", "command", cmd.Action, "target", cmd.TargetID, "err", err)
+		return
 	}
+	metrics.Message(messagePublished)
+	messagingLog.Debug("Published command", "command", cmd.Action, "target", cmd.TargetID, "params", cmd.Params)
 }
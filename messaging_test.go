@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Start a Messenger for id on hub, passing the messages it handles to the
+// returned channel.
+func startLoopbackMessenger(t *testing.T, hub *LoopbackHub, id string, signing SigningConfig) (*Messenger, <-chan Message) {
+	t.Helper()
+	auth, err := NewMessageAuth(signing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewLoopbackTransport(hub, id)
+	t.Cleanup(func() { transport.Close() })
+	m := newMessenger(id, transport, auth)
+	received := make(chan Message, 16)
+	m.StartSubscriber(func(message Message) { received <- message })
+	return m, received
+}
+
+// Wait for the next count messages.
+func receiveMessages(t *testing.T, received <-chan Message, count int) []Message {
+	t.Helper()
+	var messages []Message
+	timeout := time.After(5 * time.Second)
+	for len(messages) < count {
+		select {
+		case message := <-received:
+			messages = append(messages, message)
+		case <-timeout:
+			t.Fatalf("received %d of %d messages", len(messages), count)
+		}
+	}
+	return messages
+}
+
+func actions(messages []Message) []Command {
+	var actions []Command
+	for _, message := range messages {
+		actions = append(actions, message.Action)
+	}
+	return actions
+}
+
+func TestMessengerTargets(t *testing.T) {
+	hub := NewLoopbackHub()
+	signing := defaultSigningConfig
+	signing.AllowUnsigned = true
+	client, _ := startLoopbackMessenger(t, hub, CommandClientId, signing)
+	desk1, desk1Received := startLoopbackMessenger(t, hub, "desk1", signing)
+	_, desk2Received := startLoopbackMessenger(t, hub, "desk2", signing)
+
+	client.Publish(Move, "", "desk1", []string{"up", "500"})
+	// Targets are matched without regard to case.
+	client.Publish(Stop, "", "DESK2", nil)
+	client.Publish(Set, "", broadcastTarget, []string{"40in"})
+	// Controllers don't handle their own messages, even ones for everyone.
+	desk1.Publish(BellToll, "", broadcastTarget, []string{"enable"})
+	// Sent last so that anything that shouldn't have arrived would be in before it.
+	client.Publish(LogLevel, "", broadcastTarget, []string{"debug"})
+
+	desk1Messages := receiveMessages(t, desk1Received, 3)
+	if got, want := actions(desk1Messages), []Command{Move, Set, LogLevel}; !reflect.DeepEqual(got, want) {
+		t.Errorf("desk1 received %v; want %v", got, want)
+	}
+	desk2Messages := receiveMessages(t, desk2Received, 4)
+	if got, want := actions(desk2Messages), []Command{Stop, Set, BellToll, LogLevel}; !reflect.DeepEqual(got, want) {
+		t.Errorf("desk2 received %v; want %v", got, want)
+	}
+
+	move := desk1Messages[0]
+	if move.ID != CommandClientId || move.TargetID != "desk1" || !reflect.DeepEqual(move.Params, []string{"up", "500"}) {
+		t.Errorf("move arrived as %+v", move)
+	}
+	if move.Timestamp == 0 || move.Nonce == "" {
+		t.Errorf("move wasn't stamped: %+v", move)
+	}
+	if toll := desk2Messages[2]; toll.ID != "desk1" {
+		t.Errorf("belltoll arrived from %q; want desk1", toll.ID)
+	}
+}
+
+func TestMessengerRequestReply(t *testing.T) {
+	hub := NewLoopbackHub()
+	signing := defaultSigningConfig
+	signing.SharedKey = "secret"
+	client, clientReceived := startLoopbackMessenger(t, hub, CommandClientId, signing)
+	desk1, desk1Received := startLoopbackMessenger(t, hub, "desk1", signing)
+	_, desk2Received := startLoopbackMessenger(t, hub, "desk2", signing)
+
+	requestID, replies := client.Request(Set, "desk1", []string{"40in"})
+	defer client.replies.forget(requestID)
+	request := receiveMessages(t, desk1Received, 1)[0]
+	if request.RequestID != requestID {
+		t.Fatalf("request arrived with ID %q; want %q", request.RequestID, requestID)
+	}
+	// Reply as desk1's handler would.
+	desk1.Reply(request, CommandResult{Status: ResultAccepted})
+	desk1.Reply(request, CommandResult{Status: ResultCompleted, Height: 40})
+
+	results := receiveMessages(t, replies, 2)
+	if results[0].ID != "desk1" || results[0].Result == nil || results[0].Result.Status != ResultAccepted {
+		t.Errorf("first reply was %+v", results[0])
+	}
+	if result := results[1].Result; result == nil || *result != (CommandResult{Status: ResultCompleted, Height: 40}) {
+		t.Errorf("second reply was %+v", results[1])
+	}
+
+	// Replies go to whoever is waiting for them rather than the handler, and
+	// nothing reached desk2.
+	client.Publish(LogLevel, "", broadcastTarget, []string{"info"})
+	if got := actions(receiveMessages(t, desk2Received, 1)); !reflect.DeepEqual(got, []Command{LogLevel}) {
+		t.Errorf("desk2 received %v; want only loglevel", got)
+	}
+	select {
+	case message := <-clientReceived:
+		t.Errorf("client handler got %+v", message)
+	default:
+	}
+
+	// Commands without a request ID don't get replies.
+	desk1.Reply(Message{ID: CommandClientId, Action: Stop}, CommandResult{Status: ResultCompleted})
+	select {
+	case reply := <-replies:
+		t.Errorf("got reply %+v to a command without a request ID", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Announcements come in on the subscriber while the prompt works out who to wait
+// for, which the race detector catches if they aren't kept apart.
+func TestCommandTargetsWhileAnnouncing(t *testing.T) {
+	c := &Controller{activeControllers: make(map[string]string)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.handleCommandModeMessage(Message{Action: Announce, ID: fmt.Sprintf("desk%d", i)})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		c.commandTargets(broadcastTarget)
+	}
+	<-done
+
+	if targets := c.commandTargets(broadcastTarget); len(targets) != 100 {
+		t.Errorf("%d targets for all; want 100", len(targets))
+	}
+	if targets := c.commandTargets("Desk7"); !reflect.DeepEqual(targets, []string{"Desk7"}) {
+		t.Errorf("targets for Desk7 = %v", targets)
+	}
+}
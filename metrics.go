@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where a move was asked for, for counting moves.
+const (
+	moveSourceHTTP = "http"
+	// Commands from other controllers, whichever transport they came over.
+	moveSourceMessage = "messages"
+	// Moves made by a mode like belltoll or fixheight.
+	moveSourceMode = "mode"
+)
+
+// Outcomes of messages between controllers, for counting messages.
+const (
+	messageReceived  = "received"
+	messagePublished = "published"
+	messageFailed    = "failed"
+	// Received but not handled because the signature didn't check out.
+	messageRejected = "rejected"
+)
+
+// Metrics keeps the counts that are exported on /metrics in the Prometheus text
+// format. Values that the desk already tracks, like its height and the serial
+// frame counts, are read from it when the metrics are written.
+type Metrics struct {
+	mux sync.Mutex
+	// Direction the motor is running in, if it is, and since when.
+	motorDirection string
+	motorSince     time.Time
+	motorSeconds   map[string]float64
+	moves          map[string]float64
+	messages       map[string]float64
+	modes          map[string]bool
+}
+
+// Every label is there from the start so that a scrape always has all the series.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		motorSeconds: map[string]float64{"up": 0, "down": 0},
+		moves:        map[string]float64{moveSourceHTTP: 0, moveSourceMessage: 0, moveSourceMode: 0},
+		messages:     map[string]float64{messageReceived: 0, messagePublished: 0, messageFailed: 0, messageRejected: 0},
+		modes:        map[string]bool{string(BellToll): false, string(FixHeight): false},
+	}
+}
+
+// MotorStarted records that the motor has started going in direction.
+func (m *Metrics) MotorStarted(direction string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.stopMotor()
+	m.motorDirection, m.motorSince = direction, time.Now()
+}
+
+// MotorStopped records that the motor has stopped, if it was running.
+func (m *Metrics) MotorStopped() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.stopMotor()
+}
+
+// Must be called with mux held.
+func (m *Metrics) stopMotor() {
+	if m.motorDirection != "" {
+		m.motorSeconds[m.motorDirection] += time.Since(m.motorSince).Seconds()
+		m.motorDirection = ""
+	}
+}
+
+// MoveRequested counts a move asked for from source.
+func (m *Metrics) MoveRequested(source string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.moves[source]++
+}
+
+// Message counts a message to or from another controller with result.
+func (m *Metrics) Message(result string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.messages[result]++
+}
+
+// Run keeps track of which modes are enabled from the desk's events on sub until
+// it is unsubscribed.
+func (m *Metrics) Run(sub *Subscription) {
+	for event := range sub.C() {
+		if changed, ok := event.(ModeChangedEvent); ok {
+			m.mux.Lock()
+			m.modes[changed.Mode] = changed.Enabled
+			m.mux.Unlock()
+		}
+	}
+}
+
+// Write the metrics for desk to w in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer, desk *Desk) {
+	m.mux.Lock()
+	motorSeconds := copyMetric(m.motorSeconds)
+	if m.motorDirection != "" {
+		motorSeconds[m.motorDirection] += time.Since(m.motorSince).Seconds()
+	}
+	moves := copyMetric(m.moves)
+	messages := copyMetric(m.messages)
+	modes := make(map[string]float64, len(m.modes))
+	for mode, enabled := range m.modes {
+		modes[mode] = 0
+		if enabled {
+			modes[mode] = 1
+		}
+	}
+	m.mux.Unlock()
+
+	writeMetric(w, "sitdown_height_inches", "gauge", "Current height of the desk.",
+		"", map[string]float64{"": float64(desk.Height())})
+	writeMetric(w, "sitdown_motor_on_seconds_total", "counter", "Time the motor has been running.",
+		"direction", motorSeconds)
+	writeMetric(w, "sitdown_moves_total", "counter", "Moves asked for, by where they came from.",
+		"source", moves)
+	writeMetric(w, "sitdown_messages_total", "counter", "Messages received and published.",
+		"result", messages)
+	writeMetric(w, "sitdown_mode_active", "gauge", "Whether each mode is enabled.",
+		"mode", modes)
+	if stats, ok := desk.FrameStats(); ok {
+		writeMetric(w, "sitdown_serial_frames_total", "counter", "Frames read from the desk's serial port.",
+			"result", map[string]float64{"decoded": float64(stats.Frames), "dropped": float64(stats.BadFrames)})
+		writeMetric(w, "sitdown_serial_skipped_bytes_total", "counter", "Bytes skipped looking for a frame header.",
+			"", map[string]float64{"": float64(stats.SkippedBytes)})
+	}
+}
+
+func copyMetric(values map[string]float64) map[string]float64 {
+	copied := make(map[string]float64, len(values))
+	for label, value := range values {
+		copied[label] = value
+	}
+	return copied
+}
+
+// Write a metric with one sample per value of label, or a single sample under
+// "" if label is empty.
+func writeMetric(w io.Writer, name, kind, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	if label == "" {
+		fmt.Fprintf(w, "%s %g\n", name, values[""])
+		return
+	}
+	labels := make([]string, 0, len(values))
+	for value := range values {
+		labels = append(labels, value)
+	}
+	sort.Strings(labels)
+	for _, value := range labels {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", name, label, value, values[value])
+	}
+}
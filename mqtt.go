@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Topics are laid out under the configured prefix as:
+//
+//	sitdown/controller/desk3              commands for desk3
+//	sitdown/controller/all                commands for every controller
+//	sitdown/controller/announce/desk3     desk3's last announcement (retained)
+//	sitdown/presence/desk3/1a2b3c4d       "online" or "offline" for that client of desk3 (retained)
+//
+// IDs in command topics are lower case since targets are matched without regard to case.
+// Presence has a level for each client as well as the ID, since every command client
+// has the same ID.
+
+// First level under the prefix of presence topics. The other is the channel.
+const mqttPresenceLevel = "presence"
+
+// Payloads published to availability and presence topics. Presence is cleared
+// when a client closes, so that command clients that have gone don't stay
+// retained on the broker, and only set to mqttOffline by the will.
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// How long to wait for the broker to answer before giving up.
+const mqttTimeout = 10 * time.Second
+
+// MQTTConfig says how to reach the MQTT broker. It's read from the "MQTT" section
+// of "Messaging" in controller.conf.
+type MQTTConfig struct {
+	// URL of the broker, e.g. tcp://localhost:1883 or ssl://broker.lan:8883.
+	Broker   string
+	Username string
+	Password string
+	// Quality of service for commands and announcements: 0, 1 or 2.
+	QoS byte
+	// Prefix of every topic sitdown uses.
+	TopicPrefix string
+
+	// CA certificate to check the broker's certificate against instead of the system
+	// roots, and a client certificate and key if the broker asks for one.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// Skip checking the broker's certificate altogether. Only for testing.
+	InsecureSkipVerify bool
+}
+
+var defaultMQTTConfig = MQTTConfig{
+	Broker:      "tcp://localhost:1883",
+	QoS:         1,
+	TopicPrefix: "sitdown",
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (m MQTTConfig) Validate() error {
+	var problems []string
+	if m.Broker == "" {
+		problems = append(problems, "Broker must be set")
+	}
+	if m.QoS > 2 {
+		problems = append(problems, "QoS must be 0, 1 or 2")
+	}
+	if m.TopicPrefix == "" || strings.ContainsAny(m.TopicPrefix, "+#") {
+		problems = append(problems, "TopicPrefix must be set and must not contain + or #")
+	}
+	if (m.CertFile == "") != (m.KeyFile == "") {
+		problems = append(problems, "CertFile and KeyFile must be set together")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid Messaging.MQTT config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// The TLS settings for the config, or nil to use the defaults.
+func (m MQTTConfig) tlsConfig() (*tls.Config, error) {
+	if m.CAFile == "" && m.CertFile == "" && !m.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: m.InsecureSkipVerify}
+	if m.CAFile != "" {
+		pem, err := ioutil.ReadFile(m.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate: %s", err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", m.CAFile)
+		}
+	}
+	if m.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// MQTTTransport is a Transport that goes through an MQTT broker, like Mosquitto
+// on the local network. Commands go to a topic per controller plus one for
+// everyone, and announcements and presence are retained so that a command client
+// that connects later still sees every desk.
+type MQTTTransport struct {
+	config MQTTConfig
+	id     string
+	// Tells this client's presence apart from others with the same ID.
+	instance string
+	client   mqtt.Client
+	inbox    *mqttInbox
+
+	mux sync.Mutex
+	// Handlers to subscribe again with whenever the connection comes back.
+	subscriptions map[string]mqtt.MessageHandler
+	// Whether onConnect has taken its copy of subscriptions since the connection
+	// came up, so that Subscribe has to subscribe to anything new itself.
+	connected bool
+	// Closed once onConnect has subscribed to everything for the connection.
+	subscribed chan struct{}
+	// Clients of each controller that are online.
+	presence map[string]map[string]bool
+	// Channels announced on, to clear the announcements when closing.
+	announced map[string]bool
+}
+
+// NewMQTTTransport connects to the broker as the controller with id. If the
+// broker can't be reached it keeps trying in the background.
+func NewMQTTTransport(config MQTTConfig, id string) (*MQTTTransport, error) {
+	if err := checkTopicID(id); err != nil {
+		return nil, err
+	}
+	t := &MQTTTransport{
+		config:        config,
+		id:            id,
+		instance:      mqttInstance(),
+		inbox:         newMQTTInbox(),
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		presence:      make(map[string]map[string]bool),
+		announced:     make(map[string]bool),
+		subscribed:    make(chan struct{}),
+	}
+	options, err := config.clientOptions(id, t.instance)
+	if err != nil {
+		return nil, err
+	}
+	logLost := options.OnConnectionLost
+	options.
+		SetWill(t.ownPresenceTopic(), mqttOffline, 1, true).
+		SetOnConnectHandler(t.onConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			t.onConnectionLost()
+			logLost(client, err)
+		})
+	if t.client, err = connectMQTT(config, options); err != nil {
+		t.inbox.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Options for connecting to the broker as the given instance of the controller
+// with id. Messages are handled in the order they arrive, so handlers must hand
+// them to an mqttInbox rather than block the client.
+func (m MQTTConfig) clientOptions(id, instance string) (*mqtt.ClientOptions, error) {
+	tlsConfig, err := m.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID("sitdown-" + id + "-" + instance).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			messagingLog.Warn("Lost connection to MQTT broker", "broker", m.Broker, "err", err)
+		})
+	if tlsConfig != nil {
+		options.SetTLSConfig(tlsConfig)
+	}
+	return options, nil
+}
+
+// Connect to the broker with options. If the broker can't be reached the client
+// keeps trying in the background.
+func connectMQTT(config MQTTConfig, options *mqtt.ClientOptions) (mqtt.Client, error) {
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		messagingLog.Warn("MQTT broker isn't answering; will keep trying", "broker", config.Broker)
+	} else if token.Error() != nil {
+		return nil, fmt.Errorf("could not connect to %s: %s", config.Broker, token.Error().Error())
+	}
+	return client, nil
+}
+
+// IDs go into topics, where these characters would change which topics they match.
+const mqttTopicSpecial = "/+#"
+
+// Returns an error if id can't be used as a level of an MQTT topic.
+func checkTopicID(id string) error {
+	if id == "" || strings.ContainsAny(id, mqttTopicSpecial) {
+		return fmt.Errorf("ID %q can't be used with MQTT; it must be set and must not contain /, + or #", id)
+	}
+	return nil
+}
+
+// A random name for a client, since client IDs have to be unique and there can
+// be any number of command clients.
+func mqttInstance() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hex.EncodeToString(suffix)
+}
+
+// mqttInbox runs message handlers one at a time, in the order the messages
+// arrived, away from the client. Handlers publish replies and wait for the broker
+// to take them, which would deadlock if they held up the client.
+type mqttInbox struct {
+	mux   sync.Mutex
+	queue []func()
+	// Signalled when something is added to queue.
+	ready chan struct{}
+	done  chan struct{}
+	close sync.Once
+}
+
+func newMQTTInbox() *mqttInbox {
+	i := &mqttInbox{ready: make(chan struct{}, 1), done: make(chan struct{})}
+	go i.run()
+	return i
+}
+
+// Handler returns a handler that queues messages for handler.
+func (i *mqttInbox) Handler(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		i.mux.Lock()
+		i.queue = append(i.queue, func() { handler(client, message) })
+		i.mux.Unlock()
+		select {
+		case i.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (i *mqttInbox) run() {
+	for {
+		select {
+		case <-i.ready:
+		case <-i.done:
+			return
+		}
+		for {
+			i.mux.Lock()
+			if len(i.queue) == 0 {
+				i.mux.Unlock()
+				break
+			}
+			next := i.queue[0]
+			i.queue = i.queue[1:]
+			i.mux.Unlock()
+			next()
+		}
+	}
+}
+
+// Close stops handling messages, dropping any that haven't been handled yet.
+func (i *mqttInbox) Close() {
+	i.close.Do(func() { close(i.done) })
+}
+
+func (t *MQTTTransport) topic(parts ...string) string {
+	return t.config.TopicPrefix + "/" + strings.Join(parts, "/")
+}
+
+func (t *MQTTTransport) ownPresenceTopic() string {
+	return t.topic(mqttPresenceLevel, t.id, t.instance)
+}
+
+// Say we're online and subscribe to everything again, since the broker forgets
+// our subscriptions when the connection drops.
+func (t *MQTTTransport) onConnect(client mqtt.Client) {
+	messagingLog.Info("Connected to MQTT broker", "broker", t.config.Broker)
+	client.Publish(t.ownPresenceTopic(), 1, true, mqttOnline)
+
+	t.mux.Lock()
+	subscriptions := make(map[string]mqtt.MessageHandler, len(t.subscriptions))
+	for topic, handler := range t.subscriptions {
+		subscriptions[topic] = handler
+	}
+	t.connected = true
+	subscribed := t.subscribed
+	t.mux.Unlock()
+
+	if err := subscribeMQTT(client, t.topic(mqttPresenceLevel, "+", "+"), 1, t.handlePresence); err != nil {
+		messagingLog.Warn("Could not subscribe to presence", "broker", t.config.Broker, "err", err)
+	}
+	for topic, handler := range subscriptions {
+		if err := subscribeMQTT(client, topic, t.config.QoS, handler); err != nil {
+			messagingLog.Warn("Could not subscribe", "broker", t.config.Broker, "err", err)
+		}
+	}
+	close(subscribed)
+}
+
+// How many times to ask before giving up on a subscription the broker refuses.
+const mqttSubscribeAttempts = 3
+
+// Subscribe to topic and wait for the broker to take the subscription. Some
+// brokers refuse a subscription whose packet ID clashes with a message they're
+// still sending us, like a retained one, so a refusal is tried again.
+func subscribeMQTT(client mqtt.Client, topic string, qos byte, handler mqtt.MessageHandler) error {
+	for attempt := 1; ; attempt++ {
+		token := client.Subscribe(topic, qos, handler)
+		if !token.WaitTimeout(mqttTimeout) {
+			return fmt.Errorf("timed out subscribing to %s", topic)
+		} else if token.Error() != nil {
+			return token.Error()
+		}
+		// Anything above 2 is a refusal rather than the granted QoS.
+		code := token.(*mqtt.SubscribeToken).Result()[topic]
+		if code <= 2 {
+			return nil
+		} else if attempt == mqttSubscribeAttempts {
+			return fmt.Errorf("broker refused subscription to %s (0x%02x)", topic, code)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Leave subscribing to onConnect until the connection comes back.
+func (t *MQTTTransport) onConnectionLost() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.connected {
+		t.connected = false
+		t.subscribed = make(chan struct{})
+	}
+}
+
+// Presence is quick to handle, so it doesn't go through the inbox.
+func (t *MQTTTransport) handlePresence(_ mqtt.Client, message mqtt.Message) {
+	levels := strings.Split(strings.TrimPrefix(message.Topic(), t.topic(mqttPresenceLevel, "")), "/")
+	if len(levels) != 2 {
+		return
+	}
+	id, instance := levels[0], levels[1]
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if string(message.Payload()) == mqttOnline {
+		if t.presence[id] == nil {
+			t.presence[id] = make(map[string]bool)
+		}
+		t.presence[id][instance] = true
+	} else {
+		delete(t.presence[id], instance)
+		if len(t.presence[id]) == 0 {
+			delete(t.presence, id)
+		}
+	}
+}
+
+func (t *MQTTTransport) publish(topic string, retained bool, payload []byte) error {
+	token := t.client.Publish(topic, t.config.QoS, retained, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+func (t *MQTTTransport) Publish(channel, target string, payload []byte) error {
+	return t.publish(t.topic(channel, strings.ToLower(target)), false, payload)
+}
+
+func (t *MQTTTransport) Announce(channel string, payload []byte) error {
+	t.mux.Lock()
+	t.announced[channel] = true
+	t.mux.Unlock()
+	return t.publish(t.topic(channel, "announce", t.id), true, payload)
+}
+
+func (t *MQTTTransport) Subscribe(channel string, handler func([]byte), onError func(error)) error {
+	deliver := t.inbox.Handler(func(_ mqtt.Client, message mqtt.Message) {
+		// Empty retained messages are how announcements are cleared.
+		if len(message.Payload()) > 0 {
+			handler(message.Payload())
+		}
+	})
+	topics := []string{
+		t.topic(channel, strings.ToLower(t.id)),
+		t.topic(channel, broadcastTarget),
+		t.topic(channel, "announce", "+"),
+	}
+
+	t.mux.Lock()
+	for _, topic := range topics {
+		t.subscriptions[topic] = deliver
+	}
+	connected, subscribed := t.connected, t.subscribed
+	t.mux.Unlock()
+
+	// Otherwise onConnect will subscribe once the broker can be reached, and if
+	// it's connected already, it's about to.
+	if !connected {
+		if t.client.IsConnectionOpen() {
+			select {
+			case <-subscribed:
+			case <-time.After(mqttTimeout):
+			}
+		}
+		return nil
+	}
+	for _, topic := range topics {
+		if err := subscribeMQTT(t.client, topic, t.config.QoS, deliver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Presence lists the controllers connected to the broker, whatever the channel.
+func (t *MQTTTransport) Presence(channel string) ([]string, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var ids []string
+	for id := range t.presence {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Close clears our announcements and presence before disconnecting, since the
+// broker only sends the will when the connection is lost.
+func (t *MQTTTransport) Close() error {
+	t.mux.Lock()
+	announced := t.announced
+	t.announced = make(map[string]bool)
+	t.mux.Unlock()
+
+	var err error
+	// IsConnected is true while reconnecting, when nothing would get through.
+	if t.client.IsConnectionOpen() {
+		for channel := range announced {
+			if clearErr := t.publish(t.topic(channel, "announce", t.id), true, nil); clearErr != nil {
+				err = clearErr
+			}
+		}
+		token := t.client.Publish(t.ownPresenceTopic(), 1, true, "")
+		if !token.WaitTimeout(mqttTimeout) {
+			err = fmt.Errorf("timed out clearing presence")
+		}
+	}
+	t.client.Disconnect(250)
+	t.inbox.Close()
+	return err
+}
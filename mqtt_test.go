@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// Start an MQTT broker for the test, returning its address.
+func startBroker(t *testing.T) string {
+	t.Helper()
+	server := mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return listener.Address()
+}
+
+// dropProxy passes connections through to the broker until told to drop them,
+// which looks to both ends like the network going away.
+type dropProxy struct {
+	listener net.Listener
+	target   string
+
+	mux   sync.Mutex
+	conns []net.Conn
+	// Connections taken so far.
+	accepted int
+}
+
+func startDropProxy(t *testing.T, target string) *dropProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &dropProxy{listener: listener, target: target}
+	t.Cleanup(p.close)
+	go p.run()
+	return p
+}
+
+func (p *dropProxy) run() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		broker, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mux.Lock()
+		p.conns = append(p.conns, client, broker)
+		p.accepted++
+		p.mux.Unlock()
+		go io.Copy(broker, client)
+		go io.Copy(client, broker)
+	}
+}
+
+func (p *dropProxy) connections() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.accepted
+}
+
+// Cut every connection through the proxy.
+func (p *dropProxy) drop() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+// Cut every connection and stop taking new ones.
+func (p *dropProxy) close() {
+	p.listener.Close()
+	p.drop()
+}
+
+func newTestMQTTTransport(t *testing.T, address, id string) *MQTTTransport {
+	t.Helper()
+	config := defaultMQTTConfig
+	config.Broker = "tcp://" + address
+	transport, err := NewMQTTTransport(config, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+// Subscribe transport to the test channel, passing payloads to the returned channel.
+func subscribeTest(t *testing.T, transport *MQTTTransport) <-chan string {
+	t.Helper()
+	received := make(chan string, 16)
+	err := transport.Subscribe(sitdownChannel, func(payload []byte) {
+		received <- string(payload)
+	}, func(err error) {
+		t.Errorf("receive error: %s", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+// Wait for count payloads, and then a little longer to catch any extras.
+func receivePayloads(t *testing.T, received <-chan string, count int) []string {
+	t.Helper()
+	var payloads []string
+	timeout := time.After(5 * time.Second)
+	for len(payloads) < count {
+		select {
+		case payload := <-received:
+			payloads = append(payloads, payload)
+		case <-timeout:
+			t.Fatalf("received %v; want %d payloads", payloads, count)
+		}
+	}
+	select {
+	case payload := <-received:
+		t.Fatalf("received %q as well as %v", payload, payloads)
+	case <-time.After(200 * time.Millisecond):
+	}
+	sort.Strings(payloads)
+	return payloads
+}
+
+// Wait until condition holds.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func isPresent(transport *MQTTTransport, id string) bool {
+	ids, _ := transport.Presence(sitdownChannel)
+	for _, present := range ids {
+		if present == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMQTTTransportRouting(t *testing.T) {
+	address := startBroker(t)
+	client := newTestMQTTTransport(t, address, CommandClientId)
+	desk1 := subscribeTest(t, newTestMQTTTransport(t, address, "desk1"))
+	desk2 := subscribeTest(t, newTestMQTTTransport(t, address, "Desk2"))
+
+	for _, message := range []struct{ target, payload string }{
+		{"desk1", "for desk1"},
+		// Targets are matched without regard to case.
+		{"DESK2", "for desk2"},
+		{broadcastTarget, "for all"},
+		{"desk3", "for desk3"},
+	} {
+		if err := client.Publish(sitdownChannel, message.target, []byte(message.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := receivePayloads(t, desk1, 2); got[0] != "for all" || got[1] != "for desk1" {
+		t.Errorf("desk1 received %v", got)
+	}
+	if got := receivePayloads(t, desk2, 2); got[0] != "for all" || got[1] != "for desk2" {
+		t.Errorf("desk2 received %v", got)
+	}
+}
+
+func TestMQTTTransportRetainedAnnouncements(t *testing.T) {
+	address := startBroker(t)
+	desk1 := newTestMQTTTransport(t, address, "desk1")
+	if err := desk1.Announce(sitdownChannel, []byte("desk1 is here")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that turns up later still hears about desk1.
+	late := subscribeTest(t, newTestMQTTTransport(t, address, CommandClientId))
+	if got := receivePayloads(t, late, 1); got[0] != "desk1 is here" {
+		t.Errorf("late subscriber received %v", got)
+	}
+
+	// Closing clears the announcement, so nobody hears about a desk that's gone.
+	desk1.Close()
+	later := subscribeTest(t, newTestMQTTTransport(t, address, "desk2"))
+	receivePayloads(t, later, 0)
+}
+
+func TestMQTTTransportPresence(t *testing.T) {
+	address := startBroker(t)
+	proxy := startDropProxy(t, address)
+	observer := newTestMQTTTransport(t, address, CommandClientId)
+	newTestMQTTTransport(t, proxy.listener.Addr().String(), "desk1")
+
+	eventually(t, "desk1 to be online", func() bool { return isPresent(observer, "desk1") })
+	// Without the connection, and without a way back, the broker sends desk1's will.
+	proxy.close()
+	eventually(t, "desk1 to be offline", func() bool { return !isPresent(observer, "desk1") })
+}
+
+// Several command clients share an ID, and one leaving doesn't take the others with it.
+func TestMQTTTransportPresenceSharedID(t *testing.T) {
+	address := startBroker(t)
+	observer := newTestMQTTTransport(t, address, "desk1")
+	first := newTestMQTTTransport(t, address, CommandClientId)
+	newTestMQTTTransport(t, address, CommandClientId)
+	eventually(t, "command clients to be online", func() bool { return isPresent(observer, CommandClientId) })
+
+	first.Close()
+	time.Sleep(200 * time.Millisecond)
+	if !isPresent(observer, CommandClientId) {
+		t.Error("command client went offline with the first one")
+	}
+}
+
+// Messages are handled one at a time in the order they were sent, and handlers
+// can publish and wait for the broker, like replies do.
+func TestMQTTTransportOrder(t *testing.T) {
+	address := startBroker(t)
+	client := newTestMQTTTransport(t, address, CommandClientId)
+	replies := subscribeTest(t, client)
+	desk1 := newTestMQTTTransport(t, address, "desk1")
+	var handling sync.Mutex
+	err := desk1.Subscribe(sitdownChannel, func(payload []byte) {
+		if !handling.TryLock() {
+			t.Errorf("handling %s alongside another message", payload)
+			return
+		}
+		defer handling.Unlock()
+		if err := desk1.Publish(sitdownChannel, CommandClientId, payload); err != nil {
+			t.Errorf("could not reply to %s: %s", payload, err)
+		}
+	}, func(err error) {
+		t.Errorf("receive error: %s", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := client.Publish(sitdownChannel, "desk1", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case reply := <-replies:
+			if want := fmt.Sprint(i); reply != want {
+				t.Fatalf("reply %d was to %s; want %s", i, reply, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for reply %d", i)
+		}
+	}
+}
+
+func TestMQTTTransportResubscribes(t *testing.T) {
+	address := startBroker(t)
+	proxy := startDropProxy(t, address)
+	client := newTestMQTTTransport(t, address, CommandClientId)
+	desk1Transport := newTestMQTTTransport(t, proxy.listener.Addr().String(), "desk1")
+	desk1 := subscribeTest(t, desk1Transport)
+
+	if err := client.Publish(sitdownChannel, "desk1", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	receivePayloads(t, desk1, 1)
+
+	// The broker forgets desk1's subscriptions with the connection, so anything it
+	// gets after reconnecting is down to onConnect subscribing again.
+	proxy.drop()
+	eventually(t, "desk1 to reconnect", func() bool { return proxy.connections() > 1 })
+	eventually(t, "desk1 to get commands again", func() bool {
+		client.Publish(sitdownChannel, "desk1", []byte("after"))
+		select {
+		case <-desk1:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	})
+	eventually(t, "desk1 to be back online", func() bool { return isPresent(client, "desk1") })
+}
+
+func TestMQTTTransportRejectsTopicIDs(t *testing.T) {
+	for _, id := range []string{"desk/1", "desk+", "#", ""} {
+		if _, err := NewMQTTTransport(defaultMQTTConfig, id); err == nil {
+			t.Errorf("NewMQTTTransport accepted ID %q", id)
+		}
+	}
+}
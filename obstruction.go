@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ObstructionError is returned by moves that were cut short because the desk
+// stopped moving while the motor was running, e.g. because it hit a chair arm.
+type ObstructionError struct {
+	Direction string
+	Height    float32
+}
+
+func (e *ObstructionError) Error() string {
+	return fmt.Sprintf("desk obstructed moving %s at %.1f", e.Direction, e.Height)
+}
+
+// SetObstructionDetection configures how long the height may go unchanged while
+// the motor is running before the desk is considered obstructed (0 disables
+// detection), and how far to back away from an obstruction (0 to just stop).
+func (d *Desk) SetObstructionDetection(window time.Duration, backoff float32) {
+	d.stallWindow = window
+	d.backoffDistance = backoff
+}
+
+// stallWatch fires if the desk's height hasn't changed for the stall window.
+type stallWatch struct {
+	timer  *time.Timer
+	window time.Duration
+}
+
+func (d *Desk) watchForStall() *stallWatch {
+	watch := &stallWatch{window: d.stallWindow}
+	if watch.window > 0 {
+		watch.timer = time.NewTimer(watch.window)
+	}
+	return watch
+}
+
+// C is nil, and so never ready, if detection is disabled.
+func (w *stallWatch) C() <-chan time.Time {
+	if w.timer == nil {
+		return nil
+	}
+	return w.timer.C
+}
+
+// Moved restarts the window after a height update.
+func (w *stallWatch) Moved() {
+	if w.timer == nil {
+		return
+	}
+	if !w.timer.Stop() {
+		select {
+		case <-w.timer.C:
+		default:
+		}
+	}
+	w.timer.Reset(w.window)
+}
+
+func (w *stallWatch) Stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Called when the height hasn't changed for the stall window while moving in
+// direction. Stops the desk and, unless it has just reached the end of its
+// range, backs it off and tells subscribers that it was obstructed.
+func (d *Desk) handleStall(direction string) error {
+	d.Stop()
+	height := d.Height()
+	if d.guard != nil && d.guard.Tripped() {
+		return &SafetyError{"motor was stopped for running too long"}
+	}
+	if (direction == "up" && height >= d.profile.MaxHeight-positionTolerance) ||
+		(direction == "down" && height <= d.profile.MinHeight+positionTolerance) {
+		return nil
+	}
+
+	deskLog.Warn("Desk obstructed", "direction", direction, "height", height)
+	d.backOff(direction)
+	d.events.Publish(ObstructedEvent{Direction: direction, Height: height})
+	return &ObstructionError{Direction: direction, Height: height}
+}
+
+// Move a short distance away from an obstruction hit while moving in direction.
+func (d *Desk) backOff(direction string) {
+	if d.backoffDistance <= 0 {
+		return
+	}
+	reverse := "down"
+	if direction == "down" {
+		reverse = "up"
+	}
+	duration := d.backoffDistance / d.motion.speed(reverse) * 1000
+	deskLog.Info("Backing off", "distance", d.backoffDistance, "direction", reverse)
+	d.start(reverse)
+	sleep(int(duration))
+	d.Stop()
+}
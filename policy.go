@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Senders that requests are checked as when they don't come from another controller.
+// Modes check their moves as the mode, e.g. belltoll, and Home Assistant's commands
+// are checked as homeAssistantSender.
+const senderHTTP = "http"
+
+// Senders that requests from within sitdown are checked as, which messages from
+// other controllers can't use.
+var reservedSenders = []string{senderHTTP, homeAssistantSender, string(BellToll), string(FixHeight)}
+
+func isReservedSender(sender string) bool {
+	for _, reserved := range reservedSenders {
+		if strings.EqualFold(sender, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// What happens to commands that no rule allows.
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// Layout of the times in a rule's Hours.
+const policyTimeLayout = "15:04"
+
+// Commands that rules can allow. Stop is always allowed so that nobody can be
+// kept from stopping a desk, and announcements aren't commands as such.
+var policyCommands = []Command{Move, Set, BellToll, FixHeight, Preset, History, Summary, LogLevel}
+
+// PolicyError is returned for commands that the policy doesn't allow.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "not allowed: " + e.Reason
+}
+
+// Policy says who may send the desk which commands. It's read from the policy
+// file, and each command is allowed by the first rule that applies to its sender
+// and lets it through, or by Default if none do.
+//
+// Commands from Home Assistant aren't signed, so they're only allowed by rules
+// that name homeAssistantSender, or a group with it in: "*" rules and Default
+// don't cover them.
+type Policy struct {
+	// Named lists of sender IDs that rules can use in place of IDs.
+	Groups map[string][]string
+	Rules  []PolicyRule
+	// "allow" or "deny" commands that no rule applies to.
+	Default string
+}
+
+// PolicyRule allows some senders some commands, within limits.
+type PolicyRule struct {
+	// IDs or group names of the senders the rule applies to, or "*" for everyone.
+	Senders []string
+	// Commands the rule allows, or "*" for all of them.
+	Commands []Command
+	// Longest move in milliseconds, or 0 for no limit.
+	MaxDuration int
+	// Heights that set and fixheight may move the desk between, if set.
+	MinHeight Height
+	MaxHeight Height
+	// Time of day the rule applies, like 09:00-17:30, in local time. Windows can
+	// go past midnight. Empty for all day.
+	Hours string
+	// Days of the week the rule applies, like mon or tue. Empty for every day.
+	Days []string
+}
+
+var defaultPolicy = Policy{
+	Default: policyDeny,
+}
+
+// Validate returns an error describing everything wrong with the policy.
+func (p Policy) Validate() error {
+	var problems []string
+	if p.Default != policyAllow && p.Default != policyDeny {
+		problems = append(problems, "Default must be allow or deny")
+	}
+	for i, rule := range p.Rules {
+		if err := rule.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("rule %d: %s", i+1, err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid policy: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (r PolicyRule) validate() error {
+	var problems []string
+	if len(r.Senders) == 0 {
+		problems = append(problems, "Senders must be set")
+	}
+	if len(r.Commands) == 0 {
+		problems = append(problems, "Commands must be set")
+	}
+	for _, command := range r.Commands {
+		if command != "*" && !isPolicyCommand(command) {
+			problems = append(problems, fmt.Sprintf("unknown command %q", command))
+		}
+	}
+	if r.MaxDuration < 0 {
+		problems = append(problems, "MaxDuration must not be negative")
+	}
+	if r.MinHeight.Value != 0 && r.MaxHeight.Value != 0 && r.MinHeight.Inches() > r.MaxHeight.Inches() {
+		problems = append(problems, "MinHeight must not be above MaxHeight")
+	}
+	if r.Hours != "" {
+		if _, _, err := parsePolicyHours(r.Hours); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, day := range r.Days {
+		if _, ok := parseWeekday(day); !ok {
+			problems = append(problems, fmt.Sprintf("unknown day %q", day))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func isPolicyCommand(command Command) bool {
+	for _, c := range policyCommands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a window like 09:00-17:30 into minutes after midnight.
+func parsePolicyHours(hours string) (int, int, error) {
+	from, to, ok := strings.Cut(hours, "-")
+	start, startErr := time.Parse(policyTimeLayout, strings.TrimSpace(from))
+	end, endErr := time.Parse(policyTimeLayout, strings.TrimSpace(to))
+	if !ok || startErr != nil || endErr != nil {
+		return 0, 0, fmt.Errorf("invalid Hours %q; expected something like 09:00-17:30", hours)
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
+
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		name := strings.ToLower(weekday.String())
+		if day == name || day == name[:3] {
+			return weekday, true
+		}
+	}
+	return 0, false
+}
+
+// LoadPolicy reads the policy file at path. There's no policy, and so nothing is
+// restricted, if the file doesn't exist.
+func LoadPolicy(path string) (*Policy, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	policy := defaultPolicy
+	if err := decodeConfig(path, contents, &policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return &policy, nil
+}
+
+// A command to be checked against the policy.
+type policyRequest struct {
+	sender string
+	action Command
+	// Length of a move, if it's a move.
+	duration time.Duration
+	// Height the desk would be moved to, if known.
+	height    Height
+	hasHeight bool
+}
+
+// The reason request isn't allowed at now, if it isn't.
+func (p *Policy) check(request policyRequest, now time.Time) string {
+	var reason string
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(p.Groups, request) {
+			continue
+		}
+		ruleReason := rule.limit(request, now)
+		if ruleReason == "" {
+			return ""
+		}
+		if reason == "" {
+			reason = ruleReason
+		}
+	}
+	if reason != "" {
+		return reason
+	}
+	if p.Default == policyAllow && !unverifiedSender(request.sender) {
+		return ""
+	}
+	return fmt.Sprintf("no rule allows %s from %s", request.action, request.sender)
+}
+
+// Whether the rule is about request's sender and command.
+func (r PolicyRule) appliesTo(groups map[string][]string, request policyRequest) bool {
+	commandMatches := false
+	for _, command := range r.Commands {
+		if command == "*" || command == request.action {
+			commandMatches = true
+			break
+		}
+	}
+	if !commandMatches {
+		return false
+	}
+	for _, sender := range r.Senders {
+		if sender == "*" && !unverifiedSender(request.sender) || strings.EqualFold(sender, request.sender) {
+			return true
+		}
+		for _, member := range groups[sender] {
+			if strings.EqualFold(member, request.sender) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether commands from sender can't be verified, and so need a rule naming the sender.
+func unverifiedSender(sender string) bool {
+	return strings.EqualFold(sender, homeAssistantSender)
+}
+
+// The reason the rule's limits don't allow request at now, if they don't.
+func (r PolicyRule) limit(request policyRequest, now time.Time) string {
+	if len(r.Days) > 0 {
+		today := false
+		for _, day := range r.Days {
+			if weekday, _ := parseWeekday(day); weekday == now.Weekday() {
+				today = true
+			}
+		}
+		if !today {
+			return fmt.Sprintf("%s from %s isn't allowed on %s", request.action, request.sender, now.Weekday())
+		}
+	}
+	if r.Hours != "" {
+		start, end, _ := parsePolicyHours(r.Hours)
+		minute := now.Hour()*60 + now.Minute()
+		inside := minute >= start && minute < end
+		if end <= start {
+			inside = minute >= start || minute < end
+		}
+		if !inside {
+			return fmt.Sprintf("%s from %s is only allowed %s", request.action, request.sender, r.Hours)
+		}
+	}
+	if r.MaxDuration > 0 && request.duration > time.Duration(r.MaxDuration)*time.Millisecond {
+		return fmt.Sprintf("moves from %s may be at most %dms", request.sender, r.MaxDuration)
+	}
+	if request.hasHeight {
+		inches := request.height.Inches()
+		if r.MinHeight.Value != 0 && inches < r.MinHeight.Inches() {
+			return fmt.Sprintf("%s from %s may not go below %s", request.action, request.sender, r.MinHeight)
+		}
+		if r.MaxHeight.Value != 0 && inches > r.MaxHeight.Inches() {
+			return fmt.Sprintf("%s from %s may not go above %s", request.action, request.sender, r.MaxHeight)
+		}
+	}
+	return ""
+}
+
+// Read the policy file named in the config.
+func (c *Controller) loadPolicy(config Config) (*Policy, error) {
+	path := config.PolicyFile
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.configDir(), path)
+	}
+	return LoadPolicy(path)
+}
+
+// Authorize returns a PolicyError if the policy doesn't allow sender to send
+// action with params, after logging why.
+func (c *Controller) Authorize(sender string, action Command, params []string) error {
+	c.configMux.RLock()
+	policy := c.policy
+	c.configMux.RUnlock()
+	// Without a policy file there's no rule that could allow them.
+	if policy == nil && unverifiedSender(sender) {
+		policy = &defaultPolicy
+	}
+	if policy == nil || action == Stop || action == Announce || action == Report || action == Reply {
+		return nil
+	}
+
+	request := policyRequest{sender: sender, action: action}
+	switch action {
+	case Move:
+		// Moves without a duration take a second, like the handler does.
+		request.duration = time.Second
+		if len(params) > 1 {
+			if duration, err := strconv.Atoi(params[1]); err == nil {
+				request.duration = time.Duration(duration) * time.Millisecond
+			}
+		}
+	case Set, FixHeight:
+		// Anything that doesn't resolve is rejected by the command itself.
+		if len(params) > 0 && params[0] != "disable" {
+			if height, err := c.ResolveHeight(params[0]); err == nil {
+				request.height, request.hasHeight = height, true
+			}
+		}
+	}
+
+	if reason := policy.check(request, time.Now()); reason != "" {
+		policyLog.Warn("Denied command", "sender", sender, "command", action, "params", params, "reason", reason)
+		return &PolicyError{reason}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseHeight(t *testing.T, s string) Height {
+	t.Helper()
+	height, err := ParseHeight(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return height
+}
+
+// A Wednesday morning, unless a test says otherwise.
+var policyNow = time.Date(2024, time.March, 13, 10, 0, 0, 0, time.UTC)
+
+func at(day, hour, minute int) time.Time {
+	return time.Date(2024, time.March, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := &Policy{
+		Groups: map[string][]string{"neighbours": {"desk1", "Desk2"}},
+		Rules: []PolicyRule{
+			{
+				Senders:     []string{"neighbours"},
+				Commands:    []Command{Move, Set},
+				MaxDuration: 2000,
+				MinHeight:   mustParseHeight(t, "28in"),
+				MaxHeight:   mustParseHeight(t, "45in"),
+				Hours:       "09:00-17:30",
+				Days:        []string{"mon", "tue", "wed", "thu", "friday"},
+			},
+			{
+				Senders:  []string{"night-owl"},
+				Commands: []Command{Move},
+				Hours:    "22:00-06:00",
+			},
+			{
+				Senders:  []string{"*"},
+				Commands: []Command{Summary},
+			},
+		},
+		Default: policyDeny,
+	}
+	height := func(s string) policyRequest {
+		return policyRequest{sender: "desk1", action: Set, height: mustParseHeight(t, s), hasHeight: true}
+	}
+	move := func(sender string, duration time.Duration) policyRequest {
+		return policyRequest{sender: sender, action: Move, duration: duration}
+	}
+
+	for _, test := range []struct {
+		name    string
+		request policyRequest
+		now     time.Time
+		// Part of the reason the request is denied, or empty if it's allowed.
+		denied string
+	}{
+		{"in a group", move("desk1", time.Second), policyNow, ""},
+		{"in a group, other case", move("DESK2", time.Second), policyNow, ""},
+		{"in no rule", move("desk3", time.Second), policyNow, "no rule allows move from desk3"},
+		{"command no rule allows", policyRequest{sender: "desk1", action: LogLevel}, policyNow, "no rule allows loglevel"},
+		{"rule for everyone", policyRequest{sender: "desk3", action: Summary}, policyNow, ""},
+
+		{"longest move", move("desk1", 2*time.Second), policyNow, ""},
+		{"move too long", move("desk1", 2001*time.Millisecond), policyNow, "at most 2000ms"},
+		{"height in range", height("110cm"), policyNow, ""},
+		{"lowest height", height("28in"), policyNow, ""},
+		{"height too low", height("27.5in"), policyNow, "may not go below 28.0in"},
+		{"height too high", height("46in"), policyNow, "may not go above 45.0in"},
+		{"preset that doesn't resolve", policyRequest{sender: "desk1", action: Set}, policyNow, ""},
+
+		{"start of hours", move("desk1", time.Second), at(13, 9, 0), ""},
+		{"before hours", move("desk1", time.Second), at(13, 8, 59), "only allowed 09:00-17:30"},
+		{"end of hours", move("desk1", time.Second), at(13, 17, 30), "only allowed 09:00-17:30"},
+		{"last minute of hours", move("desk1", time.Second), at(13, 17, 29), ""},
+		{"friday", move("desk1", time.Second), at(15, 10, 0), ""},
+		{"saturday", move("desk1", time.Second), at(16, 10, 0), "isn't allowed on Saturday"},
+		{"sunday", move("desk1", time.Second), at(17, 10, 0), "isn't allowed on Sunday"},
+
+		{"before midnight", move("night-owl", time.Minute), at(13, 23, 0), ""},
+		{"at midnight", move("night-owl", time.Minute), at(14, 0, 0), ""},
+		{"after midnight", move("night-owl", time.Minute), at(14, 5, 59), ""},
+		{"end of overnight hours", move("night-owl", time.Minute), at(14, 6, 0), "only allowed 22:00-06:00"},
+		{"middle of the day", move("night-owl", time.Minute), at(14, 12, 0), "only allowed 22:00-06:00"},
+		{"start of overnight hours", move("night-owl", time.Minute), at(14, 22, 0), ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reason := policy.check(test.request, test.now)
+			if test.denied == "" && reason != "" {
+				t.Errorf("denied: %s", reason)
+			} else if test.denied != "" && !strings.Contains(reason, test.denied) {
+				t.Errorf("reason = %q; want it to contain %q", reason, test.denied)
+			}
+		})
+	}
+}
+
+// Each command is allowed by the first rule that lets it through, and denied for
+// the first rule that applies if none do.
+func TestPolicyCheckRuleOrder(t *testing.T) {
+	policy := &Policy{
+		Rules: []PolicyRule{
+			{Senders: []string{"desk1"}, Commands: []Command{Move}, MaxDuration: 500},
+			{Senders: []string{"desk1"}, Commands: []Command{"*"}, MaxDuration: 5000, Hours: "09:00-17:00"},
+			{Senders: []string{"*"}, Commands: []Command{Move}},
+		},
+		Default: policyDeny,
+	}
+
+	for _, test := range []struct {
+		name    string
+		request policyRequest
+		now     time.Time
+		denied  string
+	}{
+		{"first rule", policyRequest{sender: "desk1", action: Move, duration: 400 * time.Millisecond}, at(13, 20, 0), ""},
+		{"second rule", policyRequest{sender: "desk1", action: Move, duration: 4 * time.Second}, policyNow, ""},
+		{"rule for everyone after them", policyRequest{sender: "desk1", action: Move, duration: 10 * time.Second}, policyNow, ""},
+		{"only the second rule applies", policyRequest{sender: "desk1", action: Set}, at(13, 20, 0), "only allowed 09:00-17:00"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reason := policy.check(test.request, test.now)
+			if test.denied == "" && reason != "" {
+				t.Errorf("denied: %s", reason)
+			} else if test.denied != "" && !strings.Contains(reason, test.denied) {
+				t.Errorf("reason = %q; want it to contain %q", reason, test.denied)
+			}
+		})
+	}
+
+	// Without the rule for everyone, the reason is the first applicable rule's.
+	policy.Rules = policy.Rules[:2]
+	reason := policy.check(policyRequest{sender: "desk1", action: Move, duration: 10 * time.Second}, policyNow)
+	if want := "at most 500ms"; !strings.Contains(reason, want) {
+		t.Errorf("reason = %q; want it to contain %q", reason, want)
+	}
+}
+
+func TestPolicyCheckDefault(t *testing.T) {
+	policy := &Policy{
+		Rules:   []PolicyRule{{Senders: []string{"desk1"}, Commands: []Command{Move}, MaxDuration: 500}},
+		Default: policyAllow,
+	}
+	if reason := policy.check(policyRequest{sender: "desk2", action: Move, duration: time.Minute}, policyNow); reason != "" {
+		t.Errorf("command no rule applies to was denied: %s", reason)
+	}
+	// A rule that applies and doesn't allow the command isn't overridden by Default.
+	if reason := policy.check(policyRequest{sender: "desk1", action: Move, duration: time.Minute}, policyNow); reason == "" {
+		t.Error("command outside the rule for it was allowed")
+	}
+}
+
+// Home Assistant's commands can't be verified, so nothing allows them but a rule
+// that names it.
+func TestAuthorizeHomeAssistant(t *testing.T) {
+	everyone := &Policy{
+		Rules:   []PolicyRule{{Senders: []string{"*"}, Commands: []Command{"*"}}},
+		Default: policyAllow,
+	}
+	named := &Policy{
+		Groups:  map[string][]string{"house": {"Home-Assistant"}},
+		Rules:   []PolicyRule{{Senders: []string{"house"}, Commands: []Command{BellToll}}},
+		Default: policyDeny,
+	}
+
+	for _, test := range []struct {
+		name    string
+		policy  *Policy
+		sender  string
+		action  Command
+		allowed bool
+	}{
+		{"no policy", nil, homeAssistantSender, BellToll, false},
+		{"no policy, other controller", nil, "desk1", BellToll, true},
+		{"no policy, stop", nil, homeAssistantSender, Stop, true},
+		{"rule for everyone", everyone, homeAssistantSender, BellToll, false},
+		{"rule for everyone, other controller", everyone, "desk1", BellToll, true},
+		{"named in a group", named, homeAssistantSender, BellToll, true},
+		{"named for other commands", named, homeAssistantSender, Move, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Controller{policy: test.policy}
+			err := c.Authorize(test.sender, test.action, []string{"enable"})
+			if allowed := err == nil; allowed != test.allowed {
+				t.Errorf("Authorize(%s, %s) = %v; want allowed %t", test.sender, test.action, err, test.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Close enough to the target to not bother moving. The desk reports 0.1" steps.
+	positionTolerance float32 = 0.15
+	// Initial guess at how long the desk keeps moving after the button is let go.
+	defaultCoastTime float32 = 0.2
+	// The desk is considered at rest once no new height has arrived for this long.
+	settleQuietTime = 300 * time.Millisecond
+	settleMaxTime   = 2 * time.Second
+	// Allowance on top of twice the expected travel time before a move gives up.
+	moveDeadlineSlack = 3 * time.Second
+	// Weight given to each new measurement when updating the motion model.
+	motionLearningRate float32 = 0.3
+)
+
+// MoveResult describes how a move to a height turned out.
+type MoveResult struct {
+	Target float32
+	// Height the desk came to rest at.
+	Height float32
+	// Height - Target; positive when the desk ended up above the target.
+	Error    float32
+	Duration time.Duration
+	// True if the desk didn't get there before the deadline.
+	TimedOut bool
+	// True if the desk stopped moving before it got there.
+	Obstructed bool
+	// True if the move was cancelled part way.
+	Cancelled bool
+}
+
+func (r MoveResult) String() string {
+	if r.Cancelled {
+		return fmt.Sprintf("cancelled moving to %.1f after %s at %.1f", r.Target, r.Duration, r.Height)
+	} else if r.Obstructed {
+		return fmt.Sprintf("obstructed moving to %.1f after %s at %.1f", r.Target, r.Duration, r.Height)
+	} else if r.TimedOut {
+		return fmt.Sprintf("timed out moving to %.1f after %s at %.1f", r.Target, r.Duration, r.Height)
+	}
+	return fmt.Sprintf("moved to %.1f (target %.1f, error %+.1f) in %s", r.Height, r.Target, r.Error, r.Duration)
+}
+
+// motionModel is what the desk has learned about how it moves, used to stop the
+// motor early enough that the desk coasts to a stop at the target.
+type motionModel struct {
+	mux sync.Mutex
+	// Speed in inches per second by direction ("up" or "down").
+	speeds map[string]float32
+	// Seconds the desk keeps moving at full speed after the motor is stopped.
+	coastTime float32
+}
+
+func newMotionModel(profile DeskProfile) *motionModel {
+	return &motionModel{
+		speeds: map[string]float32{
+			"up":   profile.UpSpeed,
+			"down": profile.DownSpeed,
+		},
+		coastTime: defaultCoastTime,
+	}
+}
+
+func (m *motionModel) speed(direction string) float32 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.speeds[direction]
+}
+
+// Distance the desk is expected to coast after stopping when moving at speed.
+func (m *motionModel) coast(speed float32) float32 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return speed * m.coastTime
+}
+
+func (m *motionModel) learn(direction string, speed float32, coastTime float32) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if speed > 0 {
+		m.speeds[direction] += motionLearningRate * (speed - m.speeds[direction])
+	}
+	if coastTime >= 0 && coastTime < 1 {
+		m.coastTime += motionLearningRate * (coastTime - m.coastTime)
+	}
+}
+
+// ChangeToHeight moves the desk to height and waits for it to come to rest. The
+// motor is stopped as soon as the remaining distance is within how far the desk
+// is expected to coast, and the move gives up if it takes much longer than the
+// learned speed says it should. An error is returned if the move was refused or
+// cut short by an obstruction, the MotorGuard or ctx being cancelled.
+func (d *Desk) ChangeToHeight(ctx context.Context, height float32) (MoveResult, error) {
+	ctx, cancel := d.WithStop(ctx)
+	defer cancel()
+	if err := d.lock(ctx); err != nil {
+		return MoveResult{Target: height, Cancelled: true}, err
+	}
+	defer d.unlock()
+
+	start := time.Now()
+	startHeight := d.Height()
+	distance := height - startHeight
+	result := MoveResult{Target: height}
+	var err error
+
+	if abs(distance) > positionTolerance {
+		direction, sign := "up", float32(1)
+		if distance < 0 {
+			direction, sign = "down", -1
+		}
+		learnedSpeed := d.motion.speed(direction)
+		expected := time.Duration(abs(distance) / learnedSpeed * float32(time.Second))
+		if err := d.reserve(ctx, expected); err != nil {
+			result.Cancelled = ctx.Err() != nil
+			return result, err
+		}
+		deadline := time.NewTimer(2*expected + moveDeadlineSlack)
+		defer deadline.Stop()
+
+		d.drainHeights()
+		d.start(direction)
+		stall := d.watchForStall()
+		defer stall.Stop()
+
+		// Speed is measured from the first height update, once the motor is going.
+		var firstHeight float32
+		var firstTime time.Time
+		speed := learnedSpeed
+		stopHeight := startHeight
+	approach:
+		for {
+			select {
+			case current := <-d.heights:
+				stall.Moved()
+				now := time.Now()
+				if firstTime.IsZero() {
+					firstHeight, firstTime = current, now
+				} else if elapsed := float32(now.Sub(firstTime).Seconds()); elapsed > 0.2 {
+					speed = abs(current-firstHeight) / elapsed
+				}
+
+				remaining := (height - current) * sign
+				if remaining <= d.motion.coast(speed) {
+					d.Stop()
+					stopHeight = current
+					break approach
+				}
+			case <-stall.C():
+				stopHeight = d.Height()
+				err = d.handleStall(direction)
+				_, result.Obstructed = err.(*ObstructionError)
+				break approach
+			case <-deadline.C:
+				d.Stop()
+				stopHeight = d.Height()
+				result.TimedOut = true
+				break approach
+			case <-ctx.Done():
+				d.Stop()
+				stopHeight = d.Height()
+				err = context.Cause(ctx)
+				result.Cancelled = true
+				break approach
+			}
+		}
+
+		d.waitForRest()
+		if !result.TimedOut && err == nil && speed > 0 {
+			coasted := (d.Height() - stopHeight) * sign
+			d.motion.learn(direction, speed, coasted/speed)
+		}
+	}
+
+	result.Height = d.Height()
+	result.Error = result.Height - height
+	result.Duration = time.Since(start)
+
+	d.events.Publish(TargetReachedEvent{Result: result})
+	return result, err
+}
+
+// Wait until the height stops changing after the motor has been stopped.
+func (d *Desk) waitForRest() {
+	limit := time.NewTimer(settleMaxTime)
+	defer limit.Stop()
+	for {
+		quiet := time.NewTimer(settleQuietTime)
+		select {
+		case <-d.heights:
+			quiet.Stop()
+		case <-quiet.C:
+			return
+		case <-limit.C:
+			quiet.Stop()
+			return
+		}
+	}
+}
+
+// Throw away height updates from before the move started.
+func (d *Desk) drainHeights() {
+	for {
+		select {
+		case <-d.heights:
+		default:
+			return
+		}
+	}
+}
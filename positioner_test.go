@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// coastingDesk is a SimulatedDesk that keeps moving for a while after it's told
+// to stop, like a real desk does.
+type coastingDesk struct {
+	*SimulatedDesk
+	coast time.Duration
+}
+
+func (c *coastingDesk) Stop() {
+	time.AfterFunc(c.coast, c.SimulatedDesk.Stop)
+}
+
+// Set up a desk on actuator and sim, and wait for its first height.
+func newPositionerDesk(t *testing.T, actuator Actuator, sim *SimulatedDesk, profile DeskProfile) *Desk {
+	t.Helper()
+	desk := NewDesk(actuator, sim, profile)
+	desk.Setup()
+	t.Cleanup(desk.Cleanup)
+	eventually(t, "the desk's first height", func() bool { return desk.Height() > 0 })
+	return desk
+}
+
+func TestMotionModelLearn(t *testing.T) {
+	profile := DeskProfile{UpSpeed: 1.5, DownSpeed: 2}
+	for _, test := range []struct {
+		name             string
+		direction        string
+		speed, coast     float32
+		wantUp, wantDown float32
+		wantCoast        float32
+	}{
+		{"faster up", "up", 2.5, 0.2, 1.8, 2, 0.2},
+		{"slower down", "down", 1, 0.2, 1.5, 1.7, 0.2},
+		{"longer coast", "up", 1.5, 0.5, 1.5, 2, 0.29},
+		{"no speed measured", "up", 0, 0.2, 1.5, 2, 0.2},
+		// Coasting backwards or for a second or more is a bad measurement.
+		{"negative coast", "up", 1.5, -0.1, 1.5, 2, 0.2},
+		{"coast too long", "up", 1.5, 1, 1.5, 2, 0.2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			model := newMotionModel(profile)
+			model.learn(test.direction, test.speed, test.coast)
+			if up := model.speed("up"); abs(up-test.wantUp) > 0.001 {
+				t.Errorf("up speed = %.3f; want %.3f", up, test.wantUp)
+			}
+			if down := model.speed("down"); abs(down-test.wantDown) > 0.001 {
+				t.Errorf("down speed = %.3f; want %.3f", down, test.wantDown)
+			}
+			if coast := model.coast(1); abs(coast-test.wantCoast) > 0.001 {
+				t.Errorf("coast time = %.3f; want %.3f", coast, test.wantCoast)
+			}
+		})
+	}
+}
+
+// The motor is stopped early enough for the desk to coast to the target, and what
+// each move shows about the coast is learned for the next.
+func TestChangeToHeightCoasting(t *testing.T) {
+	profile := defaultHardwareConfig.DeskProfile()
+	sim := NewSimulatedDesk(profile)
+	desk := newPositionerDesk(t, &coastingDesk{SimulatedDesk: sim, coast: 300 * time.Millisecond}, sim, profile)
+
+	for _, target := range []float32{31, 29, 31.5} {
+		result, err := desk.ChangeToHeight(context.Background(), target)
+		if err != nil {
+			t.Fatalf("moving to %.1f: %s", target, err)
+		}
+		if result.TimedOut || result.Cancelled || result.Obstructed {
+			t.Fatalf("moving to %.1f: %s", target, result)
+		}
+		if abs(result.Error) > 0.3 {
+			t.Errorf("%s; want it within 0.3", result)
+		}
+	}
+	// The desk coasts for 0.3s, up from the 0.2s guessed at first.
+	if coast := desk.motion.coast(1); coast <= defaultCoastTime || coast > 0.4 {
+		t.Errorf("learned coast time %.2fs; want it between %.2fs and 0.4s", coast, defaultCoastTime)
+	}
+}
+
+func TestChangeToHeightAlreadyThere(t *testing.T) {
+	profile := defaultHardwareConfig.DeskProfile()
+	sim := NewSimulatedDesk(profile)
+	desk := newPositionerDesk(t, sim, sim, profile)
+
+	start := desk.Height()
+	result, err := desk.ChangeToHeight(context.Background(), start+positionTolerance/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Duration > 100*time.Millisecond || result.Height != start {
+		t.Errorf("moved when within tolerance: %s", result)
+	}
+}
+
+// A desk much slower than its profile says gives up at the deadline, and nothing
+// is learned from the move.
+func TestChangeToHeightTimeout(t *testing.T) {
+	profile := defaultHardwareConfig.DeskProfile()
+	profile.UpSpeed = 10
+	sim := NewSimulatedDesk(profile)
+	sim.UpSpeed = 0.5
+	desk := newPositionerDesk(t, sim, sim, profile)
+
+	start := time.Now()
+	result, err := desk.ChangeToHeight(context.Background(), profile.MinHeight+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TimedOut {
+		t.Fatalf("%s; want it to time out", result)
+	}
+	// 3" at 10"/s should take 0.3s, so the deadline is 0.6s plus the slack.
+	if elapsed := time.Since(start); elapsed < moveDeadlineSlack || elapsed > moveDeadlineSlack+settleMaxTime+time.Second {
+		t.Errorf("timed out after %s", elapsed)
+	}
+	if result.Height >= profile.MinHeight+3 {
+		t.Errorf("desk got to %.1f", result.Height)
+	}
+	if speed := desk.motion.speed("up"); speed != profile.UpSpeed {
+		t.Errorf("learned up speed %.2f from a move that timed out", speed)
+	}
+}
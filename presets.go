@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+// Words that already mean something in place of a height.
+var reservedPresetNames = map[string]bool{
+	"enable":  true,
+	"disable": true,
+}
+
+// Preset names start with a letter so they can't be mistaken for heights.
+func validPresetName(name string) bool {
+	if name == "" || reservedPresetNames[name] {
+		return false
+	}
+	for i, r := range name {
+		if !unicode.IsLetter(r) && (i == 0 || (!unicode.IsDigit(r) && r != '-' && r != '_')) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveHeight returns the height of the preset called s, or s parsed as a
+// height if it isn't the name of one.
+func (c *Controller) ResolveHeight(s string) (Height, error) {
+	if height, ok := c.Preset(s); ok {
+		return height, nil
+	}
+	if validPresetName(s) {
+		return Height{}, fmt.Errorf("no preset named %q", s)
+	}
+	return ParseHeight(s)
+}
+
+// Preset returns the height saved as name.
+func (c *Controller) Preset(name string) (Height, bool) {
+	c.presetMux.Lock()
+	defer c.presetMux.Unlock()
+	height, ok := c.Presets[name]
+	return height, ok
+}
+
+// PresetNames returns the names of all of the presets in alphabetical order.
+func (c *Controller) PresetNames() []string {
+	c.presetMux.Lock()
+	defer c.presetMux.Unlock()
+	return c.presetNames()
+}
+
+// Must be called with presetMux held.
+func (c *Controller) presetNames() []string {
+	names := make([]string, 0, len(c.Presets))
+	for name := range c.Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SavePreset saves height as name, replacing any preset already called that, and
+// writes the presets to the config file.
+func (c *Controller) SavePreset(name string, height Height) error {
+	if !validPresetName(name) {
+		return fmt.Errorf("invalid preset name %q; must be a letter followed by letters, digits, - or _", name)
+	}
+	profile := c.Profile()
+	if !profile.Contains(height.Inches()) {
+		return fmt.Errorf("invalid height %s; must be between %s and %s", height,
+			HeightFromInches(profile.MinHeight).In(height.Unit),
+			HeightFromInches(profile.MaxHeight).In(height.Unit))
+	}
+
+	c.presetMux.Lock()
+	defer c.presetMux.Unlock()
+	presets := c.copyPresets()
+	presets[name] = height
+	return c.savePresets(presets)
+}
+
+// DeletePreset removes the preset called name.
+func (c *Controller) DeletePreset(name string) error {
+	c.presetMux.Lock()
+	defer c.presetMux.Unlock()
+	if _, ok := c.Presets[name]; !ok {
+		return fmt.Errorf("no preset named %q", name)
+	}
+	presets := c.copyPresets()
+	delete(presets, name)
+	return c.savePresets(presets)
+}
+
+// Must be called with presetMux held.
+func (c *Controller) copyPresets() map[string]Height {
+	presets := make(map[string]Height, len(c.Presets)+1)
+	for name, height := range c.Presets {
+		presets[name] = height
+	}
+	return presets
+}
+
+// Write presets to the config file and start using them if that worked. Must be
+// called with presetMux held.
+func (c *Controller) savePresets(presets map[string]Height) error {
+	err := updateConfig(c.configPath, func(config map[string]interface{}) {
+		config["Presets"] = presets
+	})
+	if err != nil {
+		return fmt.Errorf("could not save presets: %s", err.Error())
+	}
+	c.Presets = presets
+	c.desk.Events().Publish(PresetsChangedEvent{Names: c.presetNames()})
+	return nil
+}
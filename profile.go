@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DeskProfile describes a model of desk: how its controller board frames heights
+// on the serial port, how raw heights convert to inches, and how far and fast the
+// desk moves. New models can be added to the Profiles section of controller.conf
+// without any code changes.
+type DeskProfile struct {
+	// Bytes every frame starts with, if the desk sends any. Without them frames
+	// are taken FrameLength bytes at a time from the start of the stream.
+	Header HexBytes
+	// Total length of a frame, including the header.
+	FrameLength int
+	// Index of the byte identifying the frame's type, or -1 if every frame
+	// carries a height.
+	TypeOffset int
+	// Value of the type byte for frames that carry a height.
+	HeightType byte
+	// Index and length of the raw height within a frame.
+	HeightOffset int
+	HeightBytes  int
+	// Whether multi-byte heights have their most significant byte first.
+	BigEndian bool
+
+	// Height in inches = Offset + Scale * raw.
+	Scale  float32
+	Offset float32
+
+	// Range of the desk in inches.
+	MinHeight float32
+	MaxHeight float32
+
+	// Approximate speed of the desk in inches per second.
+	UpSpeed   float32
+	DownSpeed float32
+}
+
+const defaultProfileName = "default"
+
+// Profiles for desks we know about. The default is the desk sitdown was written
+// for, which reports height in tenths of an inch in the last byte of a 4-byte
+// frame where 25 is 28.1". sitdown has always read its frames 4 bytes at a time
+// without checking what they start with, so its profile doesn't need a header.
+var builtinProfiles = map[string]DeskProfile{
+	defaultProfileName: {
+		FrameLength:  4,
+		TypeOffset:   1,
+		HeightType:   1,
+		HeightOffset: 3,
+		HeightBytes:  1,
+		Scale:        0.1,
+		Offset:       25.6,
+		MinHeight:    28.1,
+		MaxHeight:    47.5,
+		UpSpeed:      1.5,
+		DownSpeed:    1.6,
+	},
+}
+
+// Validate returns an error describing everything wrong with the profile.
+func (p DeskProfile) Validate() error {
+	var problems []string
+	if p.FrameLength <= len(p.Header) {
+		problems = append(problems, "FrameLength must be longer than Header")
+	}
+	if p.TypeOffset >= p.FrameLength || (p.TypeOffset >= 0 && p.TypeOffset < len(p.Header)) {
+		problems = append(problems, "TypeOffset must be within the frame, after Header, or -1")
+	}
+	if p.HeightBytes < 1 || p.HeightBytes > 4 {
+		problems = append(problems, "HeightBytes must be between 1 and 4")
+	} else if p.HeightOffset < len(p.Header) || p.HeightOffset+p.HeightBytes > p.FrameLength {
+		problems = append(problems, "HeightOffset and HeightBytes must be within the frame, after Header")
+	}
+	if p.Scale == 0 {
+		problems = append(problems, "Scale must not be 0")
+	}
+	if p.MinHeight <= 0 || p.MinHeight >= p.MaxHeight {
+		problems = append(problems, "MinHeight must be greater than 0 and less than MaxHeight")
+	}
+	if p.UpSpeed <= 0 || p.DownSpeed <= 0 {
+		problems = append(problems, "UpSpeed and DownSpeed must be greater than 0")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// IsHeightFrame returns true if frame carries a height.
+func (p DeskProfile) IsHeightFrame(frame Frame) bool {
+	return p.TypeOffset < 0 || frame[p.TypeOffset] == p.HeightType
+}
+
+// RawHeight decodes the raw height from a height frame. Heights are up to 4 bytes,
+// which always fit in an int64 but not in an int on 32-bit Pis.
+func (p DeskProfile) RawHeight(frame Frame) int64 {
+	data := frame[p.HeightOffset : p.HeightOffset+p.HeightBytes]
+	var raw uint64
+	for i := range data {
+		b := data[i]
+		if !p.BigEndian {
+			b = data[len(data)-1-i]
+		}
+		raw = raw<<8 | uint64(b)
+	}
+	return int64(raw)
+}
+
+// Height converts a raw height to inches.
+func (p DeskProfile) Height(raw int64) float32 {
+	return float32(float64(p.Offset) + float64(p.Scale)*float64(raw))
+}
+
+// Raw converts a height in inches to the closest raw value.
+func (p DeskProfile) Raw(height float32) int64 {
+	return int64(math.Floor(float64((height-p.Offset)/p.Scale) + 0.5))
+}
+
+// Contains returns true if height is within the range the desk can reach.
+func (p DeskProfile) Contains(height float32) bool {
+	return height >= p.MinHeight && height <= p.MaxHeight
+}
+
+// Speed returns the desk's speed in inches per second when moving in direction.
+func (p DeskProfile) Speed(direction string) float32 {
+	if direction == "down" {
+		return p.DownSpeed
+	}
+	return p.UpSpeed
+}
+
+// EncodeHeightFrame builds the frame the desk would send for height, the inverse
+// of RawHeight. Used for emulating a desk.
+func (p DeskProfile) EncodeHeightFrame(height float32) Frame {
+	frame := make(Frame, p.FrameLength)
+	copy(frame, p.Header)
+	if p.TypeOffset >= 0 {
+		frame[p.TypeOffset] = p.HeightType
+	}
+
+	raw := p.Raw(height)
+	for i := 0; i < p.HeightBytes; i++ {
+		shift := uint(8 * i)
+		if p.BigEndian {
+			shift = uint(8 * (p.HeightBytes - 1 - i))
+		}
+		frame[p.HeightOffset+i] = byte(raw >> shift)
+	}
+	return frame
+}
+
+// HexBytes is a byte slice written as a hex string in config files, e.g. "9898".
+type HexBytes []byte
+
+func (h HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("invalid hex bytes %q: %s", s, err.Error())
+	}
+	*h = decoded
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+// Raw heights use the whole of up to 4 bytes, even where an int is 32 bits.
+func TestRawHeight(t *testing.T) {
+	profile := DeskProfile{Header: HexBytes{0x98}, FrameLength: 6, TypeOffset: -1, HeightOffset: 2, HeightBytes: 4, Scale: 0.001}
+	for _, test := range []struct {
+		frame     Frame
+		bigEndian bool
+		want      int64
+	}{
+		{Frame{0x98, 0, 0x01, 0x02, 0x03, 0x04}, true, 0x01020304},
+		{Frame{0x98, 0, 0x01, 0x02, 0x03, 0x04}, false, 0x04030201},
+		{Frame{0x98, 0, 0xff, 0xff, 0xff, 0xff}, true, 0xffffffff},
+		{Frame{0x98, 0, 0x80, 0x00, 0x00, 0x00}, true, 0x80000000},
+		{Frame{0x98, 0, 0x00, 0x00, 0x00, 0x00}, false, 0},
+	} {
+		profile.BigEndian = test.bigEndian
+		if got := profile.RawHeight(test.frame); got != test.want {
+			t.Errorf("RawHeight(% x), big endian %t = %#x; want %#x", test.frame, test.bigEndian, got, test.want)
+		}
+	}
+
+	// Heights go back into frames the same way.
+	profile.BigEndian = false
+	for _, raw := range []int64{0, 255, 0x010203} {
+		height := profile.Height(raw)
+		if got := profile.RawHeight(profile.EncodeHeightFrame(height)); got != raw {
+			t.Errorf("raw %#x came back as %#x", raw, got)
+		}
+	}
+}
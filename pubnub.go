@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pubnub/go/messaging"
+)
+
+// PubNubTransport is a Transport that goes through PubNub, which needs the
+// controllers to have internet access and a set of PubNub keys.
+type PubNubTransport struct {
+	pubnub   *messaging.Pubnub
+	channels []string
+}
+
+func NewPubNubTransport(pubKey, subKey, id string) *PubNubTransport {
+	pubnub := messaging.NewPubnub(pubKey, subKey, "", "", true, "", nil)
+	pubnub.SetUUID(id)
+	return &PubNubTransport{pubnub: pubnub}
+}
+
+// Publish sends payload to everyone on channel, whatever the target.
+func (t *PubNubTransport) Publish(channel, target string, payload []byte) error {
+	successChan := make(chan []byte)
+	errorChan := make(chan []byte)
+
+	go t.pubnub.Publish(channel, string(payload), successChan, errorChan)
+	select {
+	case <-successChan:
+		return nil
+	case err := <-errorChan:
+		return errors.New(string(err))
+	case <-messaging.Timeout():
+		return fmt.Errorf("timed out publishing to %s", channel)
+	}
+}
+
+func (t *PubNubTransport) Announce(channel string, payload []byte) error {
+	return t.Publish(channel, broadcastTarget, payload)
+}
+
+func (t *PubNubTransport) Subscribe(channel string, handler func([]byte), onError func(error)) error {
+	successChan := make(chan []byte)
+	errorChan := make(chan []byte)
+
+	go t.pubnub.Subscribe(channel, "", successChan, false, errorChan)
+	t.channels = append(t.channels, channel)
+
+	go func() {
+		for {
+			select {
+			case response := <-successChan:
+				// Messages come as [[message, ...], timetoken, channel]; anything else is
+				// a notice about the subscription itself.
+				var envelope []interface{}
+				if err := json.Unmarshal(response, &envelope); err != nil {
+					onError(err)
+					continue
+				}
+				if len(envelope) == 0 {
+					continue
+				}
+				messages, ok := envelope[0].([]interface{})
+				if !ok {
+					messagingLog.Debug("Ignoring message", "message", fmt.Sprint(envelope))
+					continue
+				}
+				for _, message := range messages {
+					if payload, ok := message.(string); ok {
+						handler([]byte(payload))
+					}
+				}
+			case err := <-errorChan:
+				onError(errors.New(string(err)))
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *PubNubTransport) Presence(channel string) ([]string, error) {
+	successChan := make(chan []byte)
+	errorChan := make(chan []byte)
+
+	go t.pubnub.HereNow(channel, "", true, false, successChan, errorChan)
+	select {
+	case response := <-successChan:
+		var hereNow struct {
+			UUIDs []string `json:"uuids"`
+		}
+		if err := json.Unmarshal(response, &hereNow); err != nil {
+			return nil, err
+		}
+		return hereNow.UUIDs, nil
+	case err := <-errorChan:
+		return nil, errors.New(string(err))
+	case <-messaging.Timeout():
+		return nil, fmt.Errorf("timed out asking who is on %s", channel)
+	}
+}
+
+func (t *PubNubTransport) Close() error {
+	var errs []error
+	for _, channel := range t.channels {
+		successChan := make(chan []byte)
+		errorChan := make(chan []byte)
+
+		go t.pubnub.Unsubscribe(channel, successChan, errorChan)
+		select {
+		case <-successChan:
+			messagingLog.Info("Unsubscribed from channel", "channel", channel)
+		case err := <-errorChan:
+			errs = append(errs, fmt.Errorf("could not unsubscribe from %s: %s", channel, string(err)))
+		case <-messaging.Timeout():
+			errs = append(errs, fmt.Errorf("timed out unsubscribing from %s", channel))
+		}
+	}
+	t.channels = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long command mode waits for each target to say whether it took a command,
+// and how much longer it keeps listening for the commands it took to finish.
+const (
+	replyTimeout      = 5 * time.Second
+	completionTimeout = 2 * time.Minute
+)
+
+// ResultStatus is how a command went on the desk that received it.
+type ResultStatus string
+
+const (
+	// The desk has started on the command and will reply again when it's done.
+	ResultAccepted ResultStatus = "accepted"
+	// The desk won't carry out the command, e.g. because of the policy or bad parameters.
+	ResultRejected ResultStatus = "rejected"
+	// The desk carried out the command.
+	ResultCompleted ResultStatus = "completed"
+	// The desk tried to carry out the command and couldn't.
+	ResultFailed ResultStatus = "failed"
+)
+
+// CommandResult is what a desk replies to a command with.
+type CommandResult struct {
+	Status ResultStatus
+	// Why the command was rejected or failed.
+	Reason string `json:",omitempty"`
+	// Height of the desk once the command was done, in inches, for commands that move it.
+	Height float32 `json:",omitempty"`
+}
+
+// Final reports whether no more replies will follow this one.
+func (r CommandResult) Final() bool {
+	return r.Status != ResultAccepted
+}
+
+func (r CommandResult) String() string {
+	s := string(r.Status)
+	if r.Height > 0 {
+		s += " at " + HeightFromInches(r.Height).String()
+	}
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+	return s
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// replyTracker hands the replies that come in to whoever is waiting on the request.
+type replyTracker struct {
+	mux     sync.Mutex
+	pending map[string]chan Message
+}
+
+func newReplyTracker() *replyTracker {
+	return &replyTracker{pending: make(map[string]chan Message)}
+}
+
+// Start waiting for replies to requestID.
+func (t *replyTracker) expect(requestID string) <-chan Message {
+	// Plenty for every desk to reply twice without the subscriber waiting on us.
+	replies := make(chan Message, 64)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.pending[requestID] = replies
+	return replies
+}
+
+// Stop waiting for replies to requestID. Any that come in later are dropped.
+func (t *replyTracker) forget(requestID string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.pending, requestID)
+}
+
+// Pass reply to whoever is waiting for it, returning false if nobody is.
+func (t *replyTracker) deliver(reply Message) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	replies, ok := t.pending[reply.RequestID]
+	if !ok {
+		return false
+	}
+	select {
+	case replies <- reply:
+	default:
+		messagingLog.Warn("Dropping reply", "sender", reply.ID, "request", reply.RequestID)
+	}
+	return true
+}
+
+// Outcome of a request for each of its targets, by lower case ID.
+type requestOutcomes struct {
+	// Targets that haven't replied yet, or "all" targets we know of.
+	waiting map[string]bool
+	// Targets that accepted the command and haven't finished it.
+	accepted map[string]bool
+}
+
+func newRequestOutcomes(targets []string) *requestOutcomes {
+	o := &requestOutcomes{waiting: make(map[string]bool), accepted: make(map[string]bool)}
+	for _, target := range targets {
+		o.waiting[strings.ToLower(target)] = true
+	}
+	return o
+}
+
+// Record reply, returning the line to show for it.
+func (o *requestOutcomes) record(reply Message) string {
+	id := strings.ToLower(reply.ID)
+	delete(o.waiting, id)
+	if reply.Result == nil {
+		return fmt.Sprintf("%s: replied without a result", reply.ID)
+	}
+	if reply.Result.Final() {
+		delete(o.accepted, id)
+	} else {
+		o.accepted[id] = true
+	}
+	return fmt.Sprintf("%s: %s", reply.ID, reply.Result)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Wait for each target of the request to reply to it, showing the replies as they
+// come in, then leave the commands that were accepted to report how they finished
+// in the background so that the prompt is free for another command, like stop.
+func (c *Controller) awaitReplies(command, requestID string, targets []string, replies <-chan Message) {
+	outcomes := newRequestOutcomes(targets)
+	timeout := time.NewTimer(replyTimeout)
+	defer timeout.Stop()
+
+acknowledged:
+	for len(outcomes.waiting) > 0 || len(targets) == 0 {
+		select {
+		case reply := <-replies:
+			fmt.Println("  " + outcomes.record(reply))
+		case <-timeout.C:
+			break acknowledged
+		}
+	}
+	for _, id := range sortedKeys(outcomes.waiting) {
+		fmt.Printf("  %s: timed out\n", id)
+	}
+	if len(outcomes.accepted) == 0 {
+		messenger.replies.forget(requestID)
+		return
+	}
+
+	go func() {
+		defer messenger.replies.forget(requestID)
+		timeout := time.NewTimer(completionTimeout)
+		defer timeout.Stop()
+		for len(outcomes.accepted) > 0 {
+			select {
+			case reply := <-replies:
+				fmt.Printf("\n  [%s] %s\nCommand: ", command, outcomes.record(reply))
+			case <-timeout.C:
+				for _, id := range sortedKeys(outcomes.accepted) {
+					fmt.Printf("\n  [%s] %s: timed out\n", command, id)
+				}
+				fmt.Print("Command: ")
+				return
+			}
+		}
+	}()
+}
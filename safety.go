@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How often a delayed move checks whether the motor has cooled down enough.
+const motorBudgetPoll = 250 * time.Millisecond
+
+// SafetyError is returned for moves that the MotorGuard won't allow.
+type SafetyError struct {
+	Reason string
+}
+
+func (e *SafetyError) Error() string {
+	return "move refused: " + e.Reason
+}
+
+// MotorGuard sits between the Desk and its Actuator to protect the motor, which
+// is only rated for a low duty cycle. It keeps track of how long the motor has
+// been running over a rolling window so that moves can be delayed or refused
+// before they go over the limit, and stops the motor itself if it has been on
+// for longer than a single activation is allowed, whatever the caller is doing.
+type MotorGuard struct {
+	actuator Actuator
+
+	// Fraction of the window the motor may be on for, or 0 for no limit.
+	dutyCycle float64
+	window    time.Duration
+	maxOnTime time.Duration
+	// Longest a move will wait for the motor to cool down before it is refused.
+	maxDelay time.Duration
+
+	mux sync.Mutex
+	// Completed activations within the window.
+	runs         []motorRun
+	runningSince time.Time
+	watchdog     *time.Timer
+	tripped      bool
+}
+
+type motorRun struct {
+	start, end time.Time
+}
+
+func NewMotorGuard(actuator Actuator, dutyCycle float64, window, maxOnTime, maxDelay time.Duration) *MotorGuard {
+	return &MotorGuard{
+		actuator:  actuator,
+		dutyCycle: dutyCycle,
+		window:    window,
+		maxOnTime: maxOnTime,
+		maxDelay:  maxDelay,
+	}
+}
+
+func (g *MotorGuard) Setup() error {
+	return g.actuator.Setup()
+}
+
+func (g *MotorGuard) Raise() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.started()
+	g.actuator.Raise()
+}
+
+func (g *MotorGuard) Lower() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.started()
+	g.actuator.Lower()
+}
+
+func (g *MotorGuard) Stop() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.actuator.Stop()
+	g.stopped()
+}
+
+func (g *MotorGuard) Cleanup() {
+	g.Stop()
+	g.actuator.Cleanup()
+}
+
+// Must be called with mux held. Changing direction counts as the same activation.
+func (g *MotorGuard) started() {
+	if !g.runningSince.IsZero() {
+		return
+	}
+	g.runningSince = time.Now()
+	g.tripped = false
+	g.watchdog = time.AfterFunc(g.maxOnTime, g.trip)
+}
+
+// Must be called with mux held.
+func (g *MotorGuard) stopped() {
+	if g.runningSince.IsZero() {
+		return
+	}
+	g.watchdog.Stop()
+	g.runs = append(g.runs, motorRun{start: g.runningSince, end: time.Now()})
+	g.runningSince = time.Time{}
+}
+
+// Stop the motor because it has been running for too long.
+func (g *MotorGuard) trip() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.runningSince.IsZero() {
+		return
+	}
+	deskLog.Warn("Motor has been on for too long; stopping it", "maxOnTime", g.maxOnTime)
+	g.actuator.Stop()
+	metrics.MotorStopped()
+	g.stopped()
+	g.tripped = true
+}
+
+// Tripped returns true if the motor was stopped by the watchdog since it was last
+// started.
+func (g *MotorGuard) Tripped() bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.tripped
+}
+
+// Reserve waits until the motor can run for duration without going over the duty
+// cycle, or returns a SafetyError if that would take longer than the maximum
+// delay or the move could never be allowed. Waiting stops early if ctx is cancelled.
+func (g *MotorGuard) Reserve(ctx context.Context, duration time.Duration) error {
+	if duration > g.maxOnTime {
+		return &SafetyError{fmt.Sprintf("a %s move is longer than the motor may run for at once (%s)",
+			duration.Round(time.Millisecond), g.maxOnTime)}
+	}
+	if g.dutyCycle <= 0 {
+		return nil
+	}
+
+	allowed := time.Duration(g.dutyCycle * float64(g.window))
+	if duration > allowed {
+		return &SafetyError{fmt.Sprintf("a %s move is more than the motor may run for in %s (%s)",
+			duration.Round(time.Millisecond), g.window, allowed)}
+	}
+
+	deadline := time.Now().Add(g.maxDelay)
+	for waiting := false; ; waiting = true {
+		used := g.onTime(time.Now())
+		if used+duration <= allowed {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &SafetyError{fmt.Sprintf("motor has run for %s in the last %s; limit is %s",
+				used.Round(100*time.Millisecond), g.window, allowed)}
+		}
+		if !waiting {
+			deskLog.Info("Waiting for motor to cool down", "used", used.Round(100*time.Millisecond), "allowed", allowed)
+		}
+		select {
+		case <-time.After(motorBudgetPoll):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// How long the motor has been on during the window ending at now.
+func (g *MotorGuard) onTime(now time.Time) time.Duration {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	windowStart := now.Add(-g.window)
+	var total time.Duration
+	kept := g.runs[:0]
+	for _, run := range g.runs {
+		if run.end.Before(windowStart) {
+			continue
+		}
+		kept = append(kept, run)
+		start := run.start
+		if start.Before(windowStart) {
+			start = windowStart
+		}
+		total += run.end.Sub(start)
+	}
+	g.runs = kept
+
+	if !g.runningSince.IsZero() {
+		total += now.Sub(g.runningSince)
+	}
+	return total
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingActuator remembers what the motor was last told to do.
+type recordingActuator struct {
+	mux   sync.Mutex
+	state string
+}
+
+func (a *recordingActuator) set(state string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.state = state
+}
+
+func (a *recordingActuator) current() string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.state
+}
+
+func (a *recordingActuator) Setup() error { return nil }
+func (a *recordingActuator) Raise()       { a.set("up") }
+func (a *recordingActuator) Lower()       { a.set("down") }
+func (a *recordingActuator) Stop()        { a.set("stopped") }
+func (a *recordingActuator) Cleanup()     {}
+
+func TestMotorGuardReserve(t *testing.T) {
+	now := time.Now()
+	// A run that ended ago and lasted for.
+	ran := func(ago, lasted time.Duration) motorRun {
+		return motorRun{start: now.Add(-ago - lasted), end: now.Add(-ago)}
+	}
+
+	for _, test := range []struct {
+		name      string
+		dutyCycle float64
+		runs      []motorRun
+		// How long the motor has been running, if it is.
+		running  time.Duration
+		duration time.Duration
+		// Part of the SafetyError's reason, or empty if the move is allowed.
+		refused string
+	}{
+		{name: "no history", dutyCycle: 0.1, duration: 2 * time.Second},
+		{name: "up to the limit", dutyCycle: 0.1, runs: []motorRun{ran(time.Second, 4*time.Second)}, duration: 2 * time.Second},
+		{name: "over the limit", dutyCycle: 0.1, runs: []motorRun{ran(time.Second, 5*time.Second)}, duration: 2 * time.Second,
+			refused: "motor has run for 5s in the last 1m0s; limit is 6s"},
+		{name: "runs add up", dutyCycle: 0.1, runs: []motorRun{ran(time.Second, 3*time.Second), ran(20*time.Second, 3*time.Second)},
+			duration: time.Second, refused: "motor has run for 6s"},
+		{name: "run before the window", dutyCycle: 0.1, runs: []motorRun{ran(61*time.Second, 5*time.Second)}, duration: 5 * time.Second},
+		// Only the last 3s of this run are within the window.
+		{name: "run across the start of the window", dutyCycle: 0.1, runs: []motorRun{ran(57*time.Second, 5*time.Second)},
+			duration: 3 * time.Second},
+		{name: "running now", dutyCycle: 0.1, running: 5 * time.Second, duration: 2 * time.Second, refused: "motor has run for 5s"},
+		{name: "longer than one activation", dutyCycle: 0.1, duration: 11 * time.Second,
+			refused: "a 11s move is longer than the motor may run for at once (10s)"},
+		{name: "longer than the window allows", dutyCycle: 0.05, duration: 4 * time.Second,
+			refused: "a 4s move is more than the motor may run for in 1m0s (3s)"},
+		{name: "no duty cycle limit", runs: []motorRun{ran(time.Second, time.Minute)}, duration: 10 * time.Second},
+		{name: "no duty cycle limit, too long", duration: 11 * time.Second, refused: "longer than the motor may run for at once"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			guard := NewMotorGuard(&recordingActuator{}, test.dutyCycle, time.Minute, 10*time.Second, 0)
+			guard.runs = test.runs
+			if test.running > 0 {
+				guard.runningSince = time.Now().Add(-test.running)
+			}
+
+			err := guard.Reserve(context.Background(), test.duration)
+			var safetyErr *SafetyError
+			if test.refused == "" && err != nil {
+				t.Errorf("refused: %s", err)
+			} else if test.refused != "" && !errors.As(err, &safetyErr) {
+				t.Errorf("Reserve = %v; want a SafetyError", err)
+			} else if test.refused != "" && !strings.Contains(safetyErr.Reason, test.refused) {
+				t.Errorf("reason = %q; want it to contain %q", safetyErr.Reason, test.refused)
+			}
+		})
+	}
+}
+
+// A move over the limit waits for earlier runs to leave the window, as long as
+// that's within the maximum delay.
+func TestMotorGuardReserveWaits(t *testing.T) {
+	guard := NewMotorGuard(&recordingActuator{}, 0.5, time.Second, time.Second, 2*time.Second)
+	now := time.Now()
+	guard.runs = []motorRun{{start: now.Add(-500 * time.Millisecond), end: now}}
+
+	start := time.Now()
+	if err := guard.Reserve(context.Background(), 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 250*time.Millisecond {
+		t.Errorf("waited %s; want the motor to cool down first", waited)
+	}
+}
+
+func TestMotorGuardReserveCancelled(t *testing.T) {
+	guard := NewMotorGuard(&recordingActuator{}, 0.5, time.Minute, time.Minute, time.Minute)
+	guard.runs = []motorRun{{start: time.Now().Add(-30 * time.Second), end: time.Now()}}
+	stopped := errors.New("stopped")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() { cancel(stopped) })
+
+	err := guard.Reserve(ctx, time.Second)
+	if err != stopped {
+		t.Errorf("Reserve = %v; want %v", err, stopped)
+	}
+}
+
+// The motor is stopped once it has been on for maxOnTime, whatever the caller is
+// doing, and the run counts against the duty cycle.
+func TestMotorGuardWatchdog(t *testing.T) {
+	actuator := &recordingActuator{}
+	guard := NewMotorGuard(actuator, 0.5, time.Minute, 100*time.Millisecond, 0)
+	guard.Raise()
+	// Changing direction is the same activation.
+	time.Sleep(50 * time.Millisecond)
+	guard.Lower()
+
+	eventually(t, "the watchdog to stop the motor", guard.Tripped)
+	if state := actuator.current(); state != "stopped" {
+		t.Errorf("motor is %s after tripping", state)
+	}
+	if used := guard.onTime(time.Now()); used < 90*time.Millisecond || used > 200*time.Millisecond {
+		t.Errorf("on for %s; want about 100ms", used)
+	}
+
+	guard.Raise()
+	if guard.Tripped() {
+		t.Error("still tripped after starting again")
+	}
+	guard.Stop()
+	if state := actuator.current(); state != "stopped" {
+		t.Errorf("motor is %s after Stop", state)
+	}
+}
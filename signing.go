@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of keys that messages can be signed with, which prefix the keys in the config.
+const (
+	keyHMAC    = "hmac"
+	keyEd25519 = "ed25519"
+)
+
+// SigningConfig controls how messages between controllers are signed and which
+// ones are accepted. It's read from the "Signing" section of "Messaging" in
+// controller.conf. Keys are written as "hmac:SECRET" or "ed25519:BASE64".
+type SigningConfig struct {
+	// Accept messages that aren't signed, e.g. while keys are being rolled out.
+	// Otherwise they're rejected, and there must be keys to check messages with.
+	// Badly signed messages are rejected either way.
+	AllowUnsigned bool
+	// Key this controller signs its messages with: an HMAC secret or an Ed25519
+	// private key. If it's empty, messages are signed with SharedKey.
+	Key string
+	// HMAC secret shared by every controller, for senders that aren't in Keys.
+	SharedKey string
+	// Keys to check each sender's messages with, by ID: their HMAC secret or
+	// Ed25519 public key.
+	Keys map[string]string
+	// Seconds a message is good for after it was sent, which also allows for
+	// clocks being that far apart.
+	MaxAge int
+}
+
+var defaultSigningConfig = SigningConfig{
+	MaxAge: 30,
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (s SigningConfig) Validate() error {
+	var problems []string
+	if s.Key != "" {
+		if _, err := parseMessageKey(s.Key, true); err != nil {
+			problems = append(problems, "Key: "+err.Error())
+		}
+	}
+	if s.SharedKey != "" {
+		if _, err := parseMessageKey(keyHMAC+":"+s.SharedKey, false); err != nil {
+			problems = append(problems, "SharedKey: "+err.Error())
+		}
+	}
+	for id, key := range s.Keys {
+		if _, err := parseMessageKey(key, false); err != nil {
+			problems = append(problems, fmt.Sprintf("Keys.%s: %s", id, err.Error()))
+		}
+	}
+	if !s.AllowUnsigned && s.SharedKey == "" && len(s.Keys) == 0 {
+		problems = append(problems, "SharedKey or Keys must be set to check messages with, or AllowUnsigned to accept unsigned ones")
+	}
+	if s.MaxAge <= 0 {
+		problems = append(problems, "MaxAge must be greater than 0")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid Messaging.Signing config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// messageKey is an HMAC secret or one half of an Ed25519 key pair.
+type messageKey struct {
+	secret  []byte
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+// Parse a key written as "hmac:SECRET" or "ed25519:BASE64". Ed25519 keys are
+// private keys (or their seeds) if private is set and public keys otherwise.
+func parseMessageKey(s string, private bool) (messageKey, error) {
+	kind, value, _ := strings.Cut(s, ":")
+	switch kind {
+	case keyHMAC:
+		if value == "" {
+			return messageKey{}, errors.New("HMAC secret must not be empty")
+		}
+		return messageKey{secret: []byte(value)}, nil
+	case keyEd25519:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return messageKey{}, errors.New("Ed25519 key must be base64")
+		}
+		switch {
+		case private && len(decoded) == ed25519.SeedSize:
+			return messageKey{private: ed25519.NewKeyFromSeed(decoded)}, nil
+		case private && len(decoded) == ed25519.PrivateKeySize:
+			return messageKey{private: ed25519.PrivateKey(decoded)}, nil
+		case private:
+			return messageKey{}, errors.New("wrong length for an Ed25519 private key")
+		case len(decoded) == ed25519.PublicKeySize:
+			return messageKey{public: ed25519.PublicKey(decoded)}, nil
+		default:
+			return messageKey{}, errors.New("wrong length for an Ed25519 public key")
+		}
+	default:
+		return messageKey{}, fmt.Errorf("key must start with %s: or %s:", keyHMAC, keyEd25519)
+	}
+}
+
+func (k messageKey) sign(data []byte) []byte {
+	if k.private != nil {
+		return ed25519.Sign(k.private, data)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (k messageKey) verify(data, signature []byte) bool {
+	if k.public != nil {
+		return ed25519.Verify(k.public, data, signature)
+	}
+	return hmac.Equal(k.sign(data), signature)
+}
+
+// MessageAuth signs the messages we send and checks the ones we receive.
+type MessageAuth struct {
+	allowUnsigned bool
+	maxAge        time.Duration
+	// Key to sign with, if there is one.
+	key  *messageKey
+	keys map[string]messageKey
+	// Key for senders that aren't in keys, if there is one.
+	shared *messageKey
+
+	mux sync.Mutex
+	// Nonces of the messages accepted within maxAge, and when they were sent.
+	seen map[string]time.Time
+}
+
+// NewMessageAuth parses the keys in config, which should already have been validated.
+func NewMessageAuth(config SigningConfig) (*MessageAuth, error) {
+	a := &MessageAuth{
+		allowUnsigned: config.AllowUnsigned,
+		maxAge:        time.Duration(config.MaxAge) * time.Second,
+		keys:          make(map[string]messageKey, len(config.Keys)),
+		seen:          make(map[string]time.Time),
+	}
+	if config.SharedKey != "" {
+		shared, err := parseMessageKey(keyHMAC+":"+config.SharedKey, false)
+		if err != nil {
+			return nil, err
+		}
+		a.shared, a.key = &shared, &shared
+	}
+	if config.Key != "" {
+		key, err := parseMessageKey(config.Key, true)
+		if err != nil {
+			return nil, err
+		}
+		a.key = &key
+	}
+	for id, s := range config.Keys {
+		key, err := parseMessageKey(s, false)
+		if err != nil {
+			return nil, fmt.Errorf("key for %s: %s", id, err.Error())
+		}
+		a.keys[strings.ToLower(id)] = key
+	}
+	return a, nil
+}
+
+// The parts of a message that are signed, in a form that can't be confused with
+// a different message.
+func signedContent(message Message) []byte {
+	content, _ := json.Marshal([]interface{}{
+		message.Action, message.Params, message.ID, message.IPAddr, message.TargetID,
+		message.RequestID, message.Result, message.Timestamp, message.Nonce,
+	})
+	return content
+}
+
+// Sign stamps message with the time and a nonce and, if we have a key, signs it.
+func (a *MessageAuth) Sign(message *Message) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	message.Timestamp = time.Now().UnixMilli()
+	message.Nonce = hex.EncodeToString(nonce)
+	if a.key != nil {
+		message.Signature = base64.StdEncoding.EncodeToString(a.key.sign(signedContent(*message)))
+	}
+}
+
+// Verify returns an error saying why message should be rejected, if it should be.
+// Announcements are allowed to be old or repeated since transports may keep them
+// around for controllers that connect later.
+//
+// The sender is what the policy checks commands against, so senders with their own
+// key can only send messages signed with it, and nothing from outside may claim to
+// be one of the senders the desk checks its own requests as.
+func (a *MessageAuth) Verify(message Message) error {
+	if isReservedSender(message.ID) {
+		return fmt.Errorf("%s is reserved for requests that don't come from a controller", message.ID)
+	}
+	key, ok := a.keys[strings.ToLower(message.ID)]
+	if message.Signature == "" {
+		if !a.allowUnsigned {
+			return errors.New("message is not signed")
+		} else if ok {
+			return fmt.Errorf("message is not signed with %s's key", message.ID)
+		}
+		return nil
+	}
+
+	if !ok {
+		if a.shared == nil {
+			return fmt.Errorf("no key for %s", message.ID)
+		}
+		key = *a.shared
+	}
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil || !key.verify(signedContent(message), signature) {
+		return errors.New("signature does not match")
+	}
+	if message.Action == Announce {
+		return nil
+	}
+
+	sent := time.UnixMilli(message.Timestamp)
+	now := time.Now()
+	if sent.Before(now.Add(-a.maxAge)) || sent.After(now.Add(a.maxAge)) {
+		return fmt.Errorf("message is stale; sent at %s", sent.Format(time.RFC3339))
+	}
+	if message.Nonce == "" {
+		return errors.New("message has no nonce")
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for nonce, sentAt := range a.seen {
+		if sentAt.Before(now.Add(-a.maxAge)) {
+			delete(a.seen, nonce)
+		}
+	}
+	if _, replayed := a.seen[message.Nonce]; replayed {
+		return errors.New("message has already been received")
+	}
+	a.seen[message.Nonce] = sent
+	return nil
+}
+
+// RunKeygen is the entry point for `sitdown keygen`. It prints a new Ed25519 key
+// pair in the form the Signing config takes them.
+func RunKeygen() {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Println("Could not generate a key: " + err.Error())
+		return
+	}
+	fmt.Println("Private key (Key on this controller):")
+	fmt.Println("  " + keyEd25519 + ":" + base64.StdEncoding.EncodeToString(private.Seed()))
+	fmt.Println("Public key (Keys on the controllers that accept its messages):")
+	fmt.Println("  " + keyEd25519 + ":" + base64.StdEncoding.EncodeToString(public))
+}
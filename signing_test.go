@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func newTestAuth(t *testing.T, config SigningConfig) *MessageAuth {
+	t.Helper()
+	if config.MaxAge == 0 {
+		config.MaxAge = defaultSigningConfig.MaxAge
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewMessageAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+// A reply from desk1, which has a field of every kind that's signed.
+func testMessage() Message {
+	return Message{
+		Action:    Reply,
+		Params:    []string{"up", "500"},
+		ID:        "desk1",
+		IPAddr:    "192.168.1.20",
+		TargetID:  CommandClientId,
+		RequestID: "0123456789abcdef",
+		Result:    &CommandResult{Status: ResultCompleted, Height: 40},
+	}
+}
+
+// Sign message as sent at sent rather than now.
+func signAt(auth *MessageAuth, message *Message, sent time.Time) {
+	auth.Sign(message)
+	message.Timestamp = sent.UnixMilli()
+	message.Signature = base64.StdEncoding.EncodeToString(auth.key.sign(signedContent(*message)))
+}
+
+func TestMessageAuthRoundTrip(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Private := keyEd25519 + ":" + base64.StdEncoding.EncodeToString(private.Seed())
+	ed25519Public := keyEd25519 + ":" + base64.StdEncoding.EncodeToString(public)
+
+	for _, test := range []struct {
+		name             string
+		sender, receiver SigningConfig
+	}{
+		{
+			name:     "shared HMAC secret",
+			sender:   SigningConfig{SharedKey: "shared"},
+			receiver: SigningConfig{SharedKey: "shared"},
+		},
+		{
+			name:     "HMAC secret for the sender",
+			sender:   SigningConfig{Key: keyHMAC + ":desk1-secret", AllowUnsigned: true},
+			receiver: SigningConfig{Keys: map[string]string{"DESK1": keyHMAC + ":desk1-secret"}},
+		},
+		{
+			name:     "Ed25519",
+			sender:   SigningConfig{Key: ed25519Private, AllowUnsigned: true},
+			receiver: SigningConfig{Keys: map[string]string{"desk1": ed25519Public}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sender, receiver := newTestAuth(t, test.sender), newTestAuth(t, test.receiver)
+			message := testMessage()
+			sender.Sign(&message)
+			if message.Signature == "" {
+				t.Fatal("message wasn't signed")
+			}
+			if err := receiver.Verify(message); err != nil {
+				t.Errorf("Verify = %s", err)
+			}
+		})
+	}
+}
+
+func TestMessageAuthRejects(t *testing.T) {
+	sender := newTestAuth(t, SigningConfig{SharedKey: "shared"})
+	forger := newTestAuth(t, SigningConfig{SharedKey: "guessed"})
+	now := time.Now()
+
+	for _, test := range []struct {
+		name string
+		// Make the message that's checked from one signed by sender.
+		tamper func(*Message)
+	}{
+		{"forged signature", func(m *Message) { forger.Sign(m) }},
+		{"signature that isn't base64", func(m *Message) { m.Signature = "not base64!" }},
+		{"tampered Params", func(m *Message) { m.Params[1] = "5000" }},
+		{"tampered RequestID", func(m *Message) { m.RequestID = "fedcba9876543210" }},
+		{"tampered Result", func(m *Message) { m.Result.Status = ResultFailed }},
+		{"tampered sender", func(m *Message) { m.ID = "desk2" }},
+		{"stale", func(m *Message) { signAt(sender, m, now.Add(-time.Minute)) }},
+		{"from the future", func(m *Message) { signAt(sender, m, now.Add(time.Minute)) }},
+		{"unsigned", func(m *Message) { m.Signature = "" }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newTestAuth(t, SigningConfig{SharedKey: "shared"})
+			message := testMessage()
+			sender.Sign(&message)
+			test.tamper(&message)
+			if err := receiver.Verify(message); err == nil {
+				t.Error("Verify accepted the message")
+			}
+		})
+	}
+}
+
+func TestMessageAuthReplay(t *testing.T) {
+	sender := newTestAuth(t, SigningConfig{SharedKey: "shared"})
+	receiver := newTestAuth(t, SigningConfig{SharedKey: "shared"})
+	message := testMessage()
+	sender.Sign(&message)
+	if err := receiver.Verify(message); err != nil {
+		t.Fatalf("Verify = %s", err)
+	}
+	if err := receiver.Verify(message); err == nil {
+		t.Error("Verify accepted the same message twice")
+	}
+
+	// Announcements are kept around for controllers that connect later, so they
+	// can be old and come again.
+	announcement := Message{Action: Announce, ID: "desk1", IPAddr: "192.168.1.20"}
+	signAt(sender, &announcement, time.Now().Add(-time.Hour))
+	for i := 0; i < 2; i++ {
+		if err := receiver.Verify(announcement); err != nil {
+			t.Errorf("Verify(announcement) = %s", err)
+		}
+	}
+}
+
+func TestMessageAuthUnsigned(t *testing.T) {
+	unsigned := testMessage()
+	newTestAuth(t, SigningConfig{AllowUnsigned: true}).Sign(&unsigned)
+	if unsigned.Signature != "" {
+		t.Fatal("signed without a key")
+	}
+
+	if err := newTestAuth(t, SigningConfig{SharedKey: "shared"}).Verify(unsigned); err == nil {
+		t.Error("Verify(unsigned) accepted the message without AllowUnsigned")
+	}
+	if err := newTestAuth(t, SigningConfig{AllowUnsigned: true, SharedKey: "shared"}).Verify(unsigned); err != nil {
+		t.Errorf("Verify(unsigned) with AllowUnsigned = %s", err)
+	}
+	// A sender with its own key has to use it, even when others needn't sign.
+	withKey := newTestAuth(t, SigningConfig{AllowUnsigned: true, Keys: map[string]string{"desk1": keyHMAC + ":desk1-secret"}})
+	if err := withKey.Verify(unsigned); err == nil {
+		t.Error("Verify(unsigned) accepted a message from a sender with its own key")
+	}
+
+	// Badly signed messages are rejected even when unsigned ones aren't.
+	forged := testMessage()
+	newTestAuth(t, SigningConfig{SharedKey: "guessed"}).Sign(&forged)
+	if err := newTestAuth(t, SigningConfig{AllowUnsigned: true, SharedKey: "shared"}).Verify(forged); err == nil {
+		t.Error("Verify(forged) with AllowUnsigned accepted the message")
+	}
+}
+
+func TestSigningConfigNeedsKeysOrAllowUnsigned(t *testing.T) {
+	for _, test := range []struct {
+		config SigningConfig
+		valid  bool
+	}{
+		{SigningConfig{}, false},
+		{SigningConfig{AllowUnsigned: true}, true},
+		{SigningConfig{SharedKey: "shared"}, true},
+		{SigningConfig{Keys: map[string]string{"desk1": keyHMAC + ":desk1-secret"}}, true},
+	} {
+		test.config.MaxAge = defaultSigningConfig.MaxAge
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v; want valid %t", test.config, err, test.valid)
+		}
+	}
+}
+
+// The desk checks its own requests as these senders, so other controllers mustn't
+// be able to get the rules meant for them, whatever key they have.
+func TestMessageAuthReservedSenders(t *testing.T) {
+	sender := newTestAuth(t, SigningConfig{SharedKey: "shared"})
+	receiver := newTestAuth(t, SigningConfig{AllowUnsigned: true, SharedKey: "shared"})
+	for _, id := range []string{senderHTTP, "HTTP", homeAssistantSender, string(BellToll), string(FixHeight)} {
+		for _, signed := range []bool{true, false} {
+			message := testMessage()
+			message.ID = id
+			if signed {
+				sender.Sign(&message)
+			}
+			if err := receiver.Verify(message); err == nil {
+				t.Errorf("Verify accepted a message from %s (signed %t)", id, signed)
+			}
+		}
+	}
+}
+
+// A sender's own key is the only one its messages are checked with, so a
+// controller that only knows SharedKey can't send as it.
+func TestMessageAuthKeysTakePrecedence(t *testing.T) {
+	receiver := newTestAuth(t, SigningConfig{
+		SharedKey: "shared",
+		Keys:      map[string]string{"desk1": keyHMAC + ":desk1-secret"},
+	})
+	shared := newTestAuth(t, SigningConfig{SharedKey: "shared"})
+	own := newTestAuth(t, SigningConfig{SharedKey: "shared", Key: keyHMAC + ":desk1-secret"})
+
+	message := testMessage()
+	shared.Sign(&message)
+	if err := receiver.Verify(message); err == nil {
+		t.Error("accepted a message from desk1 signed with SharedKey")
+	}
+	message = testMessage()
+	own.Sign(&message)
+	if err := receiver.Verify(message); err != nil {
+		t.Errorf("Verify(message signed with desk1's key) = %s", err)
+	}
+
+	// Everyone else still uses SharedKey.
+	message = testMessage()
+	message.ID = "desk2"
+	shared.Sign(&message)
+	if err := receiver.Verify(message); err != nil {
+		t.Errorf("Verify(message from desk2 signed with SharedKey) = %s", err)
+	}
+}
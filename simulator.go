@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the simulated desk reports its height, similar to the real serial feed.
+const simulatedReportInterval = 50
+
+// SimulatedDesk is a pure software desk that implements both Actuator and
+// HeightSensor so that sitdown can run without a Raspberry Pi. Height is derived
+// from how long the motor has been running in either direction at the speeds in
+// the desk's profile and is clamped to its range.
+type SimulatedDesk struct {
+	UpSpeed   float32
+	DownSpeed float32
+	MinHeight float32
+	MaxHeight float32
+
+	mux sync.Mutex
+	// Height at the point the motor last changed state.
+	height float32
+	// 1 when raising, -1 when lowering and 0 when stopped.
+	direction int
+	since     time.Time
+	closed    bool
+}
+
+func NewSimulatedDesk(profile DeskProfile) *SimulatedDesk {
+	return &SimulatedDesk{
+		UpSpeed:   profile.UpSpeed,
+		DownSpeed: profile.DownSpeed,
+		MinHeight: profile.MinHeight,
+		MaxHeight: profile.MaxHeight,
+		height:    profile.MinHeight,
+		since:     time.Now(),
+	}
+}
+
+func (s *SimulatedDesk) Setup() error {
+	return nil
+}
+
+func (s *SimulatedDesk) Raise() { s.setDirection(1) }
+func (s *SimulatedDesk) Lower() { s.setDirection(-1) }
+func (s *SimulatedDesk) Stop()  { s.setDirection(0) }
+
+func (s *SimulatedDesk) Cleanup() {
+	s.Stop()
+}
+
+func (s *SimulatedDesk) setDirection(direction int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if direction == s.direction {
+		return
+	}
+	now := time.Now()
+	s.height = s.heightAt(now)
+	s.direction = direction
+	s.since = now
+}
+
+// Must be called with mux held.
+func (s *SimulatedDesk) heightAt(now time.Time) float32 {
+	elapsed := float32(now.Sub(s.since).Seconds())
+	height := s.height
+	switch s.direction {
+	case 1:
+		height += elapsed * s.UpSpeed
+	case -1:
+		height -= elapsed * s.DownSpeed
+	}
+	if height > s.MaxHeight {
+		height = s.MaxHeight
+	} else if height < s.MinHeight {
+		height = s.MinHeight
+	}
+	return height
+}
+
+// ReadHeight waits for the next report interval and returns the current height
+// rounded to the 0.1" resolution of the real serial feed.
+func (s *SimulatedDesk) ReadHeight() (float32, error) {
+	sleep(simulatedReportInterval)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return 0, errSensorClosed
+	}
+	tenths := int(s.heightAt(time.Now())*10 + 0.5)
+	return float32(tenths) / 10, nil
+}
+
+func (s *SimulatedDesk) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	return nil
+}
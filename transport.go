@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Names of the transports that can be chosen in the "Messaging" section of controller.conf.
+const (
+	transportPubNub   = "pubnub"
+	transportLoopback = "loopback"
+	transportMQTT     = "mqtt"
+)
+
+// Target of messages meant for every controller.
+const broadcastTarget = "all"
+
+// Transport carries the Messenger's payloads between controllers. Implementations
+// only move bytes around; encoding Messages and deciding which ones are for us is
+// left to the Messenger.
+type Transport interface {
+	// Publish sends payload for target, the ID of a controller or "all", to channel,
+	// blocking until it has been sent. Transports that can't route by target send
+	// it to everyone on the channel.
+	Publish(channel, target string, payload []byte) error
+	// Announce publishes payload to everyone on channel as this controller's
+	// announcement, which transports that can keep it around deliver to
+	// subscribers that turn up later too.
+	Announce(channel string, payload []byte) error
+	// Subscribe calls handler with the payloads published to channel for this
+	// controller or everyone, and onError with any errors receiving them, until the
+	// transport is closed.
+	Subscribe(channel string, handler func(payload []byte), onError func(error)) error
+	// Presence lists the IDs of the controllers currently subscribed to channel.
+	Presence(channel string) ([]string, error)
+	// Close unsubscribes from everything and releases the connection.
+	Close() error
+}
+
+// MessagingConfig chooses how controllers talk to each other. It's read from the
+// "Messaging" section of controller.conf.
+type MessagingConfig struct {
+	// "pubnub" to go through PubNub with PubKey and SubKey, "mqtt" to go through
+	// the MQTT broker below, or "loopback" to only talk to controllers in the same
+	// process.
+	Transport string
+	MQTT      MQTTConfig
+	// Keys for signing and checking messages.
+	Signing SigningConfig
+}
+
+var defaultMessagingConfig = MessagingConfig{
+	Transport: transportPubNub,
+	MQTT:      defaultMQTTConfig,
+	Signing:   defaultSigningConfig,
+}
+
+// Validate returns an error describing everything wrong with the config.
+func (m MessagingConfig) Validate() error {
+	var problems []string
+	switch m.Transport {
+	case transportPubNub, transportLoopback:
+	case transportMQTT:
+		if err := m.MQTT.Validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("invalid Messaging config: Transport must be %s, %s or %s",
+			transportPubNub, transportMQTT, transportLoopback))
+	}
+	if err := m.Signing.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// Create the transport chosen in config for the controller with id.
+func newTransport(config Config, id string) (Transport, error) {
+	switch config.Messaging.Transport {
+	case transportPubNub:
+		return NewPubNubTransport(config.PubKey, config.SubKey, id), nil
+	case transportLoopback:
+		return NewLoopbackTransport(defaultLoopbackHub, id), nil
+	case transportMQTT:
+		return NewMQTTTransport(config.Messaging.MQTT, id)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", config.Messaging.Transport)
+	}
+}
+
+// LoopbackHub connects the loopback transports created with it, standing in for
+// a message broker inside a single process.
+type LoopbackHub struct {
+	mux         sync.Mutex
+	subscribers map[string]map[*loopbackSubscriber]struct{}
+}
+
+// Hub that loopback transports chosen in config share.
+var defaultLoopbackHub = NewLoopbackHub()
+
+func NewLoopbackHub() *LoopbackHub {
+	return &LoopbackHub{subscribers: make(map[string]map[*loopbackSubscriber]struct{})}
+}
+
+// A loopback subscriber queues payloads without limit so that publishing never
+// waits on a handler, which may well be publishing itself.
+type loopbackSubscriber struct {
+	id string
+
+	mux    sync.Mutex
+	queue  [][]byte
+	ready  chan struct{}
+	closed bool
+}
+
+func newLoopbackSubscriber(id string) *loopbackSubscriber {
+	return &loopbackSubscriber{id: id, ready: make(chan struct{}, 1)}
+}
+
+func (s *loopbackSubscriber) deliver(payload []byte) {
+	s.mux.Lock()
+	if !s.closed {
+		s.queue = append(s.queue, append([]byte(nil), payload...))
+	}
+	s.mux.Unlock()
+	s.wake()
+}
+
+func (s *loopbackSubscriber) wake() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Hand queued payloads to handler until the subscriber is closed.
+func (s *loopbackSubscriber) run(handler func([]byte)) {
+	for range s.ready {
+		s.mux.Lock()
+		queue, closed := s.queue, s.closed
+		s.queue = nil
+		s.mux.Unlock()
+		for _, payload := range queue {
+			handler(payload)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (s *loopbackSubscriber) close() {
+	s.mux.Lock()
+	s.closed = true
+	s.queue = nil
+	s.mux.Unlock()
+	s.wake()
+}
+
+// LoopbackTransport is a Transport that delivers payloads to the other transports
+// on the same hub without leaving the process. Like a real broker, publishers get
+// their own payloads back and handlers run on their own goroutine.
+type LoopbackTransport struct {
+	hub *LoopbackHub
+	id  string
+
+	mux         sync.Mutex
+	subscribers map[string]*loopbackSubscriber
+}
+
+func NewLoopbackTransport(hub *LoopbackHub, id string) *LoopbackTransport {
+	return &LoopbackTransport{hub: hub, id: id, subscribers: make(map[string]*loopbackSubscriber)}
+}
+
+func (t *LoopbackTransport) Publish(channel, target string, payload []byte) error {
+	t.hub.mux.Lock()
+	defer t.hub.mux.Unlock()
+	for sub := range t.hub.subscribers[channel] {
+		sub.deliver(payload)
+	}
+	return nil
+}
+
+func (t *LoopbackTransport) Announce(channel string, payload []byte) error {
+	return t.Publish(channel, broadcastTarget, payload)
+}
+
+func (t *LoopbackTransport) Subscribe(channel string, handler func([]byte), onError func(error)) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if _, ok := t.subscribers[channel]; ok {
+		return fmt.Errorf("already subscribed to %s", channel)
+	}
+	sub := newLoopbackSubscriber(t.id)
+	t.subscribers[channel] = sub
+
+	t.hub.mux.Lock()
+	if t.hub.subscribers[channel] == nil {
+		t.hub.subscribers[channel] = make(map[*loopbackSubscriber]struct{})
+	}
+	t.hub.subscribers[channel][sub] = struct{}{}
+	t.hub.mux.Unlock()
+
+	go sub.run(handler)
+	return nil
+}
+
+func (t *LoopbackTransport) Presence(channel string) ([]string, error) {
+	t.hub.mux.Lock()
+	defer t.hub.mux.Unlock()
+	var ids []string
+	for sub := range t.hub.subscribers[channel] {
+		ids = append(ids, sub.id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (t *LoopbackTransport) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.hub.mux.Lock()
+	defer t.hub.mux.Unlock()
+	for channel, sub := range t.subscribers {
+		delete(t.hub.subscribers[channel], sub)
+		sub.close()
+	}
+	t.subscribers = make(map[string]*loopbackSubscriber)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Unit is a unit of length that heights can be given in.
+type Unit string
+
+const (
+	Inches      Unit = "in"
+	Centimetres Unit = "cm"
+	Millimetres Unit = "mm"
+)
+
+// Number of inches in one of each unit.
+var inchesPerUnit = map[Unit]float64{
+	Inches:      1,
+	Centimetres: 1 / 2.54,
+	Millimetres: 1 / 25.4,
+}
+
+// Other ways people write the units.
+var unitAliases = map[string]Unit{
+	"":            Inches,
+	"in":          Inches,
+	"inch":        Inches,
+	"inches":      Inches,
+	"\"":          Inches,
+	"cm":          Centimetres,
+	"centimeter":  Centimetres,
+	"centimeters": Centimetres,
+	"centimetre":  Centimetres,
+	"centimetres": Centimetres,
+	"mm":          Millimetres,
+	"millimeter":  Millimetres,
+	"millimeters": Millimetres,
+	"millimetre":  Millimetres,
+	"millimetres": Millimetres,
+}
+
+// ParseUnit parses the name of a unit. An empty string is inches.
+func ParseUnit(s string) (Unit, error) {
+	unit, ok := unitAliases[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return "", fmt.Errorf("unknown unit %q", s)
+	}
+	return unit, nil
+}
+
+// Height is a length along with the unit it was given in. The desk works in
+// inches internally; Height is for getting values to and from people.
+type Height struct {
+	Value float32
+	Unit  Unit
+}
+
+// HeightFromInches wraps a height in inches from the desk.
+func HeightFromInches(inches float32) Height {
+	return Height{Value: inches, Unit: Inches}
+}
+
+// ParseHeight parses a height such as "43", "43in", "110cm" or "1100 mm". Numbers
+// without a unit are in inches, which is what sitdown has always used.
+func ParseHeight(s string) (Height, error) {
+	s = strings.TrimSpace(s)
+	split := strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789.+-", r)
+	})
+	number, suffix := s, ""
+	if split >= 0 {
+		number, suffix = s[:split], s[split:]
+	}
+
+	// Values too big for a float32 come back as infinity along with an error.
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 32)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Height{}, fmt.Errorf("invalid height %q", s)
+	} else if value < 0 {
+		return Height{}, fmt.Errorf("invalid height %q: must not be negative", s)
+	}
+	unit, err := ParseUnit(suffix)
+	if err != nil {
+		return Height{}, fmt.Errorf("invalid height %q: %s", s, err.Error())
+	}
+	return Height{Value: float32(value), Unit: unit}, nil
+}
+
+// Inches returns the height converted to inches.
+func (h Height) Inches() float32 {
+	return float32(float64(h.Value) * inchesPerUnit[h.Unit])
+}
+
+// In returns the height converted to unit.
+func (h Height) In(unit Unit) Height {
+	return Height{
+		Value: float32(float64(h.Value) * inchesPerUnit[h.Unit] / inchesPerUnit[unit]),
+		Unit:  unit,
+	}
+}
+
+func (h Height) String() string {
+	return fmt.Sprintf("%.1f%s", h.Value, h.Unit)
+}
+
+// MarshalText writes heights in config files the same way people type them.
+func (h Height) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Height) UnmarshalText(text []byte) error {
+	height, err := ParseHeight(string(text))
+	if err != nil {
+		return err
+	}
+	*h = height
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestParseHeight(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want Height
+		// Whether s should be rejected.
+		invalid bool
+	}{
+		{s: "43", want: Height{43, Inches}},
+		{s: "43in", want: Height{43, Inches}},
+		{s: "43 inches", want: Height{43, Inches}},
+		{s: `43"`, want: Height{43, Inches}},
+		{s: "110cm", want: Height{110, Centimetres}},
+		{s: " 110 CM ", want: Height{110, Centimetres}},
+		{s: "110 centimetres", want: Height{110, Centimetres}},
+		{s: "1100mm", want: Height{1100, Millimetres}},
+		{s: "1100 Millimeters", want: Height{1100, Millimetres}},
+		{s: "43.5", want: Height{43.5, Inches}},
+		{s: ".5in", want: Height{0.5, Inches}},
+		{s: "110.25cm", want: Height{110.25, Centimetres}},
+		{s: "+43", want: Height{43, Inches}},
+		{s: "0", want: Height{0, Inches}},
+
+		{s: "", invalid: true},
+		{s: "cm", invalid: true},
+		{s: "43ft", invalid: true},
+		{s: "43 cm mm", invalid: true},
+		{s: "4.3.5", invalid: true},
+		{s: "1/2", invalid: true},
+		{s: "43e1", invalid: true},
+		{s: "NaN", invalid: true},
+		{s: "nan cm", invalid: true},
+		{s: "Inf", invalid: true},
+		{s: "+Inf", invalid: true},
+		{s: "-inf", invalid: true},
+		{s: "-5", invalid: true},
+		{s: "-0.1cm", invalid: true},
+		// Too big for a float32.
+		{s: "1000000000000000000000000000000000000000", invalid: true},
+		{s: "340282356779733661637539395458142568448mm", invalid: true},
+	} {
+		got, err := ParseHeight(test.s)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseHeight(%q) = %v; want an error", test.s, got)
+			}
+		} else if err != nil {
+			t.Errorf("ParseHeight(%q) = %s", test.s, err)
+		} else if got != test.want {
+			t.Errorf("ParseHeight(%q) = %v; want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestHeightConversion(t *testing.T) {
+	for _, test := range []struct {
+		height Height
+		inches float32
+	}{
+		{Height{43, Inches}, 43},
+		{Height{110, Centimetres}, 43.307},
+		{Height{1100, Millimetres}, 43.307},
+		{Height{2.54, Centimetres}, 1},
+	} {
+		if got := test.height.Inches(); abs(got-test.inches) > 0.001 {
+			t.Errorf("%v.Inches() = %.3f; want %.3f", test.height, got, test.inches)
+		}
+	}
+	if got := HeightFromInches(43).In(Centimetres); abs(got.Value-109.22) > 0.01 || got.Unit != Centimetres {
+		t.Errorf("43in in cm = %v; want 109.2cm", got)
+	}
+}